@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	lastResultAnnotation = "policy.opsmx.io/last-result"
+	eventComponent       = "policy-job"
+	eventTypeNormal      = "Normal"
+	eventTypeWarning     = "Warning"
+	maxEventMessage      = 1024
+)
+
+var recordOnApplication, recordLastResult bool
+
+// LastResult is the value of the last-result annotation, a short summary of the latest run.
+type LastResult struct {
+	Mode    string   `json:"mode"`
+	Outcome string   `json:"outcome"`
+	Time    string   `json:"time"`
+	Failed  []string `json:"failed,omitempty"`
+}
+
+// eventReasons maps result outcomes to event reasons, skipped checks are not recorded.
+var eventReasons = map[string]string{
+	outcomePass:  "PolicyCheckPassed",
+	outcomeWarn:  "PolicyCheckWarning",
+	outcomeFail:  "PolicyCheckFailed",
+	outcomeError: "PolicyCheckError",
+}
+
+// recordResultsOnApplication emits, with --record-on-application, one event per check result on the
+// application and, with --last-result-annotation, sets its last-result annotation, so operators see why a hook failed
+// without the hook pod logs.
+// Failures are logged only, like the run report they never change the outcome of the run.
+func recordResultsOnApplication(mode string, runErr error) {
+	if (!recordOnApplication && !recordLastResult) || strings.TrimSpace(argocdAppName) == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kubeReportTimeout)
+	defer cancel()
+	client, err := NewKubeClient()
+	if err != nil {
+		log.Printf("WARNING: could not record results on application %s: %v", argocdAppName, err)
+		return
+	}
+
+	var errs []error
+	if recordOnApplication {
+		errs = append(errs, recordResultEvents(ctx, client, mode)...)
+	}
+
+	if recordLastResult {
+		lastResult, err := json.Marshal(newLastResult(mode, runErr))
+		if err == nil {
+			value := string(lastResult)
+			err = client.PatchApplicationAnnotations(ctx, argocdNamespace, argocdAppName, map[string]*string{lastResultAnnotation: &value})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("annotation %s: %v", lastResultAnnotation, err))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		log.Printf("WARNING: could not record results on application %s: %v", argocdAppName, err)
+	}
+}
+
+// recordResultEvents emits one event per check result, skipped checks are not recorded.
+func recordResultEvents(ctx context.Context, client *KubeClient, mode string) []error {
+	involvedObject := ObjectReference{ApiVersion: "argoproj.io/v1alpha1", Kind: "Application", Namespace: argocdNamespace, Name: argocdAppName}
+	if app, err := client.GetApplication(ctx, argocdNamespace, argocdAppName); err == nil {
+		involvedObject.UID = app.Metadata.UID
+		involvedObject.ResourceVersion = app.Metadata.ResourceVersion
+	} else {
+		log.Printf("WARNING: could not fetch application %s for its events: %v", argocdAppName, err)
+	}
+
+	var errs []error
+	for _, result := range runReport.Results() {
+		reason, ok := eventReasons[result.Outcome]
+		if !ok {
+			continue
+		}
+		if err := client.CreateEvent(ctx, argocdNamespace, newResultEvent(involvedObject, reason, mode, result)); err != nil {
+			errs = append(errs, fmt.Errorf("event for %s %s: %v", result.Check, result.Subject, err))
+		}
+	}
+	return errs
+}
+
+func newResultEvent(involvedObject ObjectReference, reason, mode string, result CheckResult) Event {
+	eventType := eventTypeNormal
+	if result.Outcome != outcomePass {
+		eventType = eventTypeWarning
+	}
+	message := fmt.Sprintf("%s %s %s: %s", mode, result.Check, result.Subject, result.Message)
+	if len(result.Links) > 0 {
+		message += " (" + strings.Join(redactLinks(result.Links), ", ") + ")"
+	}
+	message = redactSecrets(message)
+	if len(message) > maxEventMessage {
+		message = message[:maxEventMessage-3] + "..."
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	host, _ := os.Hostname()
+	return Event{
+		ApiVersion:         "v1",
+		Kind:               "Event",
+		Metadata:           ObjectMeta{GenerateName: argocdAppName + ".", Namespace: argocdNamespace},
+		InvolvedObject:     involvedObject,
+		Reason:             reason,
+		Message:            message,
+		Type:               eventType,
+		Source:             EventSource{Component: eventComponent, Host: host},
+		ReportingComponent: eventComponent,
+		ReportingInstance:  host,
+		FirstTimestamp:     now,
+		LastTimestamp:      now,
+		Count:              1,
+	}
+}
+
+func newLastResult(mode string, runErr error) LastResult {
+	lastResult := LastResult{Mode: mode, Outcome: outcomePass, Time: time.Now().UTC().Format(time.RFC3339)}
+	if runErr != nil {
+		lastResult.Outcome = outcomeFail
+	}
+	for _, result := range runReport.Failed() {
+		lastResult.Failed = append(lastResult.Failed, redactSecrets(fmt.Sprintf("%s %s: %s", result.Check, result.Subject, result.Message)))
+	}
+	if runErr != nil && len(lastResult.Failed) == 0 {
+		lastResult.Failed = []string{redactSecrets(runErr.Error())}
+	}
+	return lastResult
+}
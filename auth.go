@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	opsmxAuth  = "opsmx"
+	bearerAuth = "bearer"
+	basicAuth  = "basic"
+	oauth2Auth = "oauth2"
+	mtlsAuth   = "mtls"
+	noAuth     = "none"
+)
+
+const authFlagUsage = "authentication as type=opsmx|bearer|basic|oauth2|mtls|none with token[-from], username, password[-from], token-url, client-id, client-secret[-from], scope, cert and key, defaults to the service token in the X-OpsMx-Auth header"
+
+var releaseCheckAuth, servicenowAuth, submitDeploymentAuth string
+
+// Authenticator adds the credentials of an endpoint to an outgoing request.
+type Authenticator interface {
+	Authenticate(ctx context.Context, request *http.Request) error
+}
+
+// refreshingAuthenticator is an Authenticator with cached credentials that can be dropped when
+// the endpoint rejects them.
+type refreshingAuthenticator interface {
+	Authenticator
+	Invalidate()
+}
+
+// opsmxAuthenticator sends the token in the X-OpsMx-Auth header.
+type opsmxAuthenticator struct {
+	token *Credential
+}
+
+func (a *opsmxAuthenticator) Authenticate(ctx context.Context, request *http.Request) error {
+	request.Header.Set(opsmxToken, a.token.Value())
+	return nil
+}
+
+type bearerAuthenticator struct {
+	token *Credential
+}
+
+func (a *bearerAuthenticator) Authenticate(ctx context.Context, request *http.Request) error {
+	request.Header.Set("Authorization", "Bearer "+a.token.Value())
+	return nil
+}
+
+type basicAuthenticator struct {
+	username string
+	password *Credential
+}
+
+func (a *basicAuthenticator) Authenticate(ctx context.Context, request *http.Request) error {
+	request.SetBasicAuth(a.username, a.password.Value())
+	return nil
+}
+
+const tokenRefreshMargin = time.Minute
+
+// oauth2Authenticator fetches an access token with the OAuth2 client credentials grant, or the
+// password grant when a username is set, and caches it until shortly before it expires, or until
+// the endpoint rejects it.
+type oauth2Authenticator struct {
+	tokenUrl     string
+	clientId     string
+	clientSecret *Credential
+	username     string
+	password     *Credential
+	scope        string
+	httpClient   *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	tokenExpiry time.Time
+}
+
+func (a *oauth2Authenticator) Authenticate(ctx context.Context, request *http.Request) error {
+	accessToken, err := a.token(ctx)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+accessToken)
+	return nil
+}
+
+func (a *oauth2Authenticator) Invalidate() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.accessToken = ""
+}
+
+func (a *oauth2Authenticator) token(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.accessToken != "" && (a.tokenExpiry.IsZero() || time.Now().Before(a.tokenExpiry)) {
+		return a.accessToken, nil
+	}
+
+	form := url.Values{}
+	form.Set("client_id", a.clientId)
+	form.Set("client_secret", a.clientSecret.Value())
+	if a.username != "" {
+		form.Set("grant_type", "password")
+		form.Set("username", a.username)
+		form.Set("password", a.password.Value())
+	} else {
+		form.Set("grant_type", "client_credentials")
+	}
+	if a.scope != "" {
+		form.Set("scope", a.scope)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, a.tokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+
+	resp, err := a.httpClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("error requesting oauth2 token: %v", err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oauth2 token request returned httpstatus code %d", resp.StatusCode)
+	}
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(content, &tokenResponse); err != nil {
+		return "", fmt.Errorf("error parsing oauth2 token response: %v", err)
+	}
+	if tokenResponse.AccessToken == "" {
+		return "", fmt.Errorf("oauth2 token response did not contain an access_token")
+	}
+	registerSecret(tokenResponse.AccessToken)
+	a.accessToken = tokenResponse.AccessToken
+	a.tokenExpiry = tokenExpiry(time.Now(), time.Duration(tokenResponse.ExpiresIn)*time.Second)
+	return a.accessToken, nil
+}
+
+// tokenExpiry is when a token valid for lifetime is fetched again. Short-lived tokens are refreshed
+// after half their lifetime instead of a full margin early, and a token without expires_in is kept
+// until the endpoint rejects it.
+func tokenExpiry(now time.Time, lifetime time.Duration) time.Time {
+	if lifetime <= 0 {
+		return time.Time{}
+	}
+	margin := tokenRefreshMargin
+	if lifetime < 2*margin {
+		margin = lifetime / 2
+	}
+	return now.Add(lifetime - margin)
+}
+
+// clientCertificate loads the mutual TLS certificate on every handshake, so a rotated
+// certificate is picked up like a rotated token file.
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+}
+
+func (c *clientCertificate) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading client certificate %s: %v", c.certFile, err)
+	}
+	return &certificate, nil
+}
+
+// authTransport authenticates every request, and retries once with fresh credentials when a
+// refreshing authenticator's cached credentials are rejected.
+type authTransport struct {
+	next http.RoundTripper
+	auth Authenticator
+}
+
+func (t *authTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	authenticated := request.Clone(request.Context())
+	if err := t.auth.Authenticate(request.Context(), authenticated); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(authenticated)
+	refreshing, ok := t.auth.(refreshingAuthenticator)
+	if err != nil || !ok || resp.StatusCode != http.StatusUnauthorized || (request.Body != nil && request.GetBody == nil) {
+		return resp, err
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	refreshing.Invalidate()
+	retry := request.Clone(request.Context())
+	if request.Body != nil {
+		if retry.Body, err = request.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	if err := t.auth.Authenticate(request.Context(), retry); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(retry)
+}
+
+// parseAuthSpec reads an --<endpoint>-auth flag such as "type=bearer,token-from=file:/var/run/token".
+// Without a spec the endpoint uses defaultType. Tokens default to the service token, cert and key
+// add a client certificate to any type.
+func parseAuthSpec(endpoint, spec, defaultType string, options *EndpointOptions) error {
+	values := map[string]string{"type": defaultType}
+	for _, part := range strings.Split(spec, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return fmt.Errorf("%s-auth: %q should be key=value", endpoint, part)
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	flag := endpoint + "-auth"
+	known := map[string]bool{"type": true, "cert": true, "key": true}
+	credential := func(name string) *Credential {
+		known[name], known[name+"-from"] = true, true
+		c := &Credential{flag: flag + " " + name, value: values[name], source: values[name+"-from"]}
+		credentials = append(credentials, c)
+		return c
+	}
+	token := func() *Credential {
+		if values["token"] == "" && values["token-from"] == "" {
+			known["token"], known["token-from"] = true, true
+			serviceTokenEndpoints[endpoint] = true
+			return serviceToken
+		}
+		return credential("token")
+	}
+
+	switch values["type"] {
+	case opsmxAuth:
+		options.Auth = &opsmxAuthenticator{token: token()}
+	case bearerAuth:
+		options.Auth = &bearerAuthenticator{token: token()}
+	case basicAuth:
+		known["username"] = true
+		if values["username"] == "" || (values["password"] == "" && values["password-from"] == "") {
+			return fmt.Errorf("%s: username and password or password-from have to be set for basic auth", flag)
+		}
+		options.Auth = &basicAuthenticator{username: values["username"], password: credential("password")}
+	case oauth2Auth:
+		known["token-url"], known["client-id"], known["scope"], known["username"] = true, true, true, true
+		if values["token-url"] == "" || values["client-id"] == "" || (values["client-secret"] == "" && values["client-secret-from"] == "") {
+			return fmt.Errorf("%s: token-url, client-id and client-secret or client-secret-from have to be set for oauth2", flag)
+		}
+		authenticator := &oauth2Authenticator{
+			tokenUrl:     values["token-url"],
+			clientId:     values["client-id"],
+			clientSecret: credential("client-secret"),
+			scope:        values["scope"],
+		}
+		// a username switches to the password grant
+		if values["username"] != "" {
+			authenticator.username, authenticator.password = values["username"], credential("password")
+		}
+		options.Auth = authenticator
+	case mtlsAuth, noAuth:
+	default:
+		return fmt.Errorf("%s: unknown type %q, should be %s, %s, %s, %s, %s or %s", flag, values["type"], opsmxAuth, bearerAuth, basicAuth, oauth2Auth, mtlsAuth, noAuth)
+	}
+	for key := range values {
+		if !known[key] {
+			return fmt.Errorf("%s: unknown key %q for type %s", flag, key, values["type"])
+		}
+	}
+
+	if values["cert"] != "" || values["key"] != "" || values["type"] == mtlsAuth {
+		if values["cert"] == "" || values["key"] == "" {
+			return fmt.Errorf("%s: cert and key have to be set for a client certificate", flag)
+		}
+		certificate := &clientCertificate{certFile: values["cert"], keyFile: values["key"]}
+		if _, err := certificate.GetClientCertificate(nil); err != nil {
+			return fmt.Errorf("%s: %v", flag, err)
+		}
+		options.ClientCertificate = certificate
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	opsmxChangeBackend      = "opsmx"
+	serviceNowChangeBackend = "servicenow"
+	serviceNowTablePath     = "/api/now/table/change_request"
+	serviceNowOAuthPath     = "/oauth_token.do"
+	serviceNowTimeLayout    = "2006-01-02 15:04:05"
+)
+
+// serviceNowNumberPattern is what a change number may look like. It keeps encoded query operators
+// such as ^ or = out of sysparm_query, where they would select other records.
+var serviceNowNumberPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+var changeBackend string
+var serviceNowInstanceUrl, serviceNowUsername string
+var serviceNowClientId, serviceNowIdentifierField string
+
+// ChangeManager looks up change tickets in a change-management system.
+type ChangeManager interface {
+	// GetChange returns the change ticket snowId mapped onto the ServiceNowResponse shape
+	// that checkServiceNowStatus evaluates.
+	GetChange(ctx context.Context, snowId string) (ServiceNowResponse, error)
+	// AddWorkNote appends note to the work notes of the change ticket.
+	AddWorkNote(ctx context.Context, snowId string, note string) error
+	// SetState moves the change ticket to state, note is used as close notes where the state needs them.
+	SetState(ctx context.Context, snowId string, state string, note string) error
+}
+
+// ErrUnsupportedChangeOperation is returned by backends that can only read change tickets.
+var ErrUnsupportedChangeOperation = errors.New("operation is not supported by this change backend")
+
+// NewChangeManager returns the change-management backend selected by --change-backend.
+func NewChangeManager() (ChangeManager, error) {
+	switch changeBackend {
+	case "", opsmxChangeBackend:
+		if strings.TrimSpace(servicenowCheckUrl) == "" {
+			return nil, fmt.Errorf("servicenow-check-url flag has to be set for the %s change backend", opsmxChangeBackend)
+		}
+		return &OpsmxChangeManager{url: servicenowCheckUrl, httpClient: serviceNowClient}, nil
+	case serviceNowChangeBackend:
+		if strings.TrimSpace(serviceNowInstanceUrl) == "" {
+			return nil, fmt.Errorf("servicenow-instance-url flag has to be set for the %s change backend", serviceNowChangeBackend)
+		}
+		return NewServiceNowChangeManager(serviceNowInstanceUrl, serviceNowClient)
+	}
+	return nil, fmt.Errorf("unknown change-backend %q, should either be %s or %s", changeBackend, opsmxChangeBackend, serviceNowChangeBackend)
+}
+
+// changeValidationEnabled reports whether presync has to validate change tickets.
+func changeValidationEnabled() bool {
+	if changeBackend == serviceNowChangeBackend {
+		return strings.TrimSpace(serviceNowInstanceUrl) != ""
+	}
+	return strings.TrimSpace(servicenowCheckUrl) != ""
+}
+
+// changeManagerUrl is the endpoint change tickets are read from, for the run report.
+func changeManagerUrl() string {
+	if changeBackend == serviceNowChangeBackend {
+		return strings.TrimRight(serviceNowInstanceUrl, "/") + serviceNowTablePath
+	}
+	return servicenowCheckUrl
+}
+
+// OpsmxChangeManager reads change tickets through the OpsMx servicenow proxy.
+type OpsmxChangeManager struct {
+	url        string
+	httpClient *http.Client
+}
+
+func (m *OpsmxChangeManager) GetChange(ctx context.Context, snowId string) (ServiceNowResponse, error) {
+	statusCode, responseBytes, err := getForServiceNowCheckHost(m.httpClient, m.url, snowId)
+	if err != nil {
+		return ServiceNowResponse{}, fmt.Errorf("ERROR: While servicenow validation for SnowId %s - err: %v", snowId, err)
+	}
+
+	if statusCode != http.StatusOK {
+		return ServiceNowResponse{}, fmt.Errorf("ERROR: While servicenow validation for SnowId %s - httpstatus code %d", snowId, statusCode)
+	}
+
+	var serviceNowResponse ServiceNowResponse
+	if err := json.Unmarshal(responseBytes, &serviceNowResponse); err != nil {
+		return ServiceNowResponse{}, fmt.Errorf("ERROR: While parsing service now response: %v", err)
+	}
+	return serviceNowResponse, nil
+}
+
+// AddWorkNote is not offered by the OpsMx servicenow proxy.
+func (m *OpsmxChangeManager) AddWorkNote(ctx context.Context, snowId string, note string) error {
+	return fmt.Errorf("adding a work note to %s through the %s change backend: %w", snowId, opsmxChangeBackend, ErrUnsupportedChangeOperation)
+}
+
+// SetState is not offered by the OpsMx servicenow proxy.
+func (m *OpsmxChangeManager) SetState(ctx context.Context, snowId string, state string, note string) error {
+	return fmt.Errorf("moving %s to %s through the %s change backend: %w", snowId, state, opsmxChangeBackend, ErrUnsupportedChangeOperation)
+}
+
+// ServiceNowChangeManager reads and updates change tickets through the ServiceNow change_request table api.
+// Requests are authenticated by the servicenow endpoint client, see serviceNowTableAuth.
+type ServiceNowChangeManager struct {
+	instanceUrl     string
+	identifierField string
+	httpClient      *http.Client
+}
+
+func NewServiceNowChangeManager(instanceUrl string, httpClient *http.Client) (*ServiceNowChangeManager, error) {
+	if strings.TrimSpace(servicenowAuth) == "" && strings.TrimSpace(serviceNowClientId) == "" && strings.TrimSpace(serviceNowUsername) == "" {
+		return nil, fmt.Errorf("one of servicenow-auth, servicenow-username or servicenow-client-id has to be set for the %s change backend", serviceNowChangeBackend)
+	}
+	return &ServiceNowChangeManager{
+		instanceUrl:     strings.TrimSuffix(instanceUrl, "/"),
+		identifierField: serviceNowIdentifierField,
+		httpClient:      httpClient,
+	}, nil
+}
+
+// serviceNowTableAuth sets the authenticator of the servicenow endpoint for the table api when
+// --servicenow-auth is not given: OAuth through oauth_token.do with servicenow-client-id, using the
+// password grant when servicenow-username is set too, and basic auth with only servicenow-username.
+func serviceNowTableAuth(options *EndpointOptions) error {
+	clientId, username := strings.TrimSpace(serviceNowClientId), strings.TrimSpace(serviceNowUsername)
+	if strings.TrimSpace(servicenowAuth) != "" {
+		if clientId != "" || username != "" {
+			return fmt.Errorf("servicenow-auth cannot be combined with servicenow-username or servicenow-client-id")
+		}
+		return nil
+	}
+	switch {
+	case clientId != "":
+		options.Auth = &oauth2Authenticator{
+			tokenUrl:     strings.TrimSuffix(serviceNowInstanceUrl, "/") + serviceNowOAuthPath,
+			clientId:     clientId,
+			clientSecret: serviceNowClientSecret,
+			username:     username,
+			password:     serviceNowPassword,
+		}
+	case username != "":
+		options.Auth = &basicAuthenticator{username: username, password: serviceNowPassword}
+	}
+	return nil
+}
+
+// serviceNowField is a field read with sysparm_display_value=all, which returns both the
+// stored value and the label shown in the ServiceNow ui.
+type serviceNowField struct {
+	Value        string `json:"value"`
+	DisplayValue string `json:"display_value"`
+}
+
+type serviceNowTableResponse struct {
+	Result []map[string]serviceNowField `json:"result"`
+}
+
+func (m *ServiceNowChangeManager) GetChange(ctx context.Context, snowId string) (ServiceNowResponse, error) {
+	record, err := m.findChange(ctx, snowId, "sys_id", "number", "state", "start_date", "end_date", "approval", "risk", "cmdb_ci", m.identifierField)
+	if err != nil {
+		return ServiceNowResponse{}, err
+	}
+	return m.toServiceNowResponse(record)
+}
+
+func (m *ServiceNowChangeManager) AddWorkNote(ctx context.Context, snowId string, note string) error {
+	return m.updateChange(ctx, snowId, map[string]string{"work_notes": note})
+}
+
+func (m *ServiceNowChangeManager) SetState(ctx context.Context, snowId string, state string, note string) error {
+	fields := map[string]string{"state": state}
+	if strings.TrimSpace(changeCloseCode) != "" {
+		fields["close_code"] = changeCloseCode
+		fields["close_notes"] = note
+	}
+	return m.updateChange(ctx, snowId, fields)
+}
+
+// findChange returns the change_request record numbered snowId with the requested fields.
+func (m *ServiceNowChangeManager) findChange(ctx context.Context, snowId string, fields ...string) (map[string]serviceNowField, error) {
+	if !serviceNowNumberPattern.MatchString(snowId) {
+		return nil, fmt.Errorf("ERROR: %q is not a servicenow change number", snowId)
+	}
+	query := url.Values{}
+	query.Set("sysparm_query", "number="+snowId)
+	query.Set("sysparm_limit", "1")
+	query.Set("sysparm_display_value", "all")
+	query.Set("sysparm_exclude_reference_link", "true")
+	query.Set("sysparm_fields", strings.Join(fields, ","))
+
+	var tableResponse serviceNowTableResponse
+	if err := m.do(ctx, http.MethodGet, serviceNowTablePath+"?"+query.Encode(), nil, &tableResponse); err != nil {
+		return nil, fmt.Errorf("ERROR: While servicenow validation for SnowId %s - err: %v", snowId, err)
+	}
+	if len(tableResponse.Result) == 0 {
+		return nil, fmt.Errorf("ERROR: change request %s not found in servicenow", snowId)
+	}
+	return tableResponse.Result[0], nil
+}
+
+// updateChange patches fields on the change_request numbered snowId. Values are display values,
+// so states can be configured by their label, e.g. "Review".
+func (m *ServiceNowChangeManager) updateChange(ctx context.Context, snowId string, fields map[string]string) error {
+	record, err := m.findChange(ctx, snowId, "sys_id")
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	path := serviceNowTablePath + "/" + url.PathEscape(record["sys_id"].Value) + "?sysparm_input_display_value=true&sysparm_fields=sys_id"
+	if err := m.do(ctx, http.MethodPatch, path, body, nil); err != nil {
+		return fmt.Errorf("ERROR: While updating servicenow change %s - err: %v", snowId, err)
+	}
+	return nil
+}
+
+func (m *ServiceNowChangeManager) do(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, m.instanceUrl+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := m.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("httpstatus code %d", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(content, out); err != nil {
+		return fmt.Errorf("error parsing servicenow response: %v", err)
+	}
+	return nil
+}
+
+// toServiceNowResponse maps a change_request record onto the proxy response shape. State uses the
+// ui label (e.g. "Scheduled"), dates are the stored UTC values converted to RFC3339.
+func (m *ServiceNowChangeManager) toServiceNowResponse(record map[string]serviceNowField) (ServiceNowResponse, error) {
+	startTime, err := serviceNowTimeToRFC3339(record["start_date"].Value)
+	if err != nil {
+		return ServiceNowResponse{}, fmt.Errorf("error parsing start_date of %s: %v", record["number"].Value, err)
+	}
+	endTime, err := serviceNowTimeToRFC3339(record["end_date"].Value)
+	if err != nil {
+		return ServiceNowResponse{}, fmt.Errorf("error parsing end_date of %s: %v", record["number"].Value, err)
+	}
+	return ServiceNowResponse{
+		State:     record["state"].DisplayValue,
+		StartTime: startTime,
+		EndTime:   endTime,
+		Approval:  record["approval"].DisplayValue,
+		Risk:      record["risk"].DisplayValue,
+		MainConfigurationItem: MainConfigurationItem{
+			Name: record["cmdb_ci"].DisplayValue,
+			Number: ConfigurationItemNumber{
+				Identifier: record[m.identifierField].Value,
+			},
+		},
+	}, nil
+}
+
+func serviceNowTimeToRFC3339(value string) (string, error) {
+	if strings.TrimSpace(value) == "" {
+		return "", nil
+	}
+	t, err := time.ParseInLocation(serviceNowTimeLayout, value, time.UTC)
+	if err != nil {
+		return "", err
+	}
+	return t.Format(time.RFC3339), nil
+}
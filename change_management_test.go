@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// serviceNowConfig points the servicenow change backend at url and restores the flags afterwards.
+func serviceNowConfig(t *testing.T, url, clientId, username string) {
+	t.Helper()
+	backend, instanceUrl, savedClientId, savedUsername, auth, identifier := changeBackend, serviceNowInstanceUrl, serviceNowClientId, serviceNowUsername, servicenowAuth, serviceNowIdentifierField
+	password, clientSecret := serviceNowPassword.value, serviceNowClientSecret.value
+	t.Cleanup(func() {
+		changeBackend, serviceNowInstanceUrl, serviceNowClientId, serviceNowUsername, servicenowAuth, serviceNowIdentifierField = backend, instanceUrl, savedClientId, savedUsername, auth, identifier
+		serviceNowPassword.value, serviceNowClientSecret.value = password, clientSecret
+	})
+	changeBackend, serviceNowInstanceUrl = serviceNowChangeBackend, url
+	serviceNowClientId, serviceNowUsername, servicenowAuth = clientId, username, ""
+	serviceNowIdentifierField = "u_identifier"
+	serviceNowPassword.value, serviceNowClientSecret.value = "change-password", "client-secret"
+	if err := setupHTTPClients(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestChangeManager(t *testing.T) ChangeManager {
+	t.Helper()
+	manager, err := NewChangeManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager
+}
+
+const changeRecord = `{"result":[{
+	"sys_id":{"value":"abc123","display_value":"abc123"},
+	"number":{"value":"CHG0001","display_value":"CHG0001"},
+	"state":{"value":"-2","display_value":"Scheduled"},
+	"start_date":{"value":"2024-05-01 08:00:00","display_value":"05/01/2024 10:00:00"},
+	"end_date":{"value":"2024-05-01 12:30:00","display_value":"05/01/2024 14:30:00"},
+	"approval":{"value":"approved","display_value":"Approved"},
+	"risk":{"value":"4","display_value":"Low"},
+	"cmdb_ci":{"value":"0f1e","display_value":"payments-api"},
+	"u_identifier":{"value":"CI-42","display_value":"CI-42"}}]}`
+
+func TestServiceNowGetChange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != serviceNowTablePath {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		query := r.URL.Query()
+		if got := query.Get("sysparm_query"); got != "number=CHG0001" {
+			t.Errorf("sysparm_query = %q", got)
+		}
+		if got := query.Get("sysparm_display_value"); got != "all" {
+			t.Errorf("sysparm_display_value = %q", got)
+		}
+		if got := query.Get("sysparm_fields"); got != "sys_id,number,state,start_date,end_date,approval,risk,cmdb_ci,u_identifier" {
+			t.Errorf("sysparm_fields = %q", got)
+		}
+		if username, password, ok := r.BasicAuth(); !ok || username != "change-user" || password != "change-password" {
+			t.Errorf("basic auth = %q, %q, %v", username, password, ok)
+		}
+		fmt.Fprint(w, changeRecord)
+	}))
+	defer server.Close()
+	serviceNowConfig(t, server.URL+"/", "", "change-user")
+
+	change, err := newTestChangeManager(t).GetChange(context.Background(), "CHG0001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ServiceNowResponse{
+		State:     "Scheduled",
+		StartTime: "2024-05-01T08:00:00Z",
+		EndTime:   "2024-05-01T12:30:00Z",
+		Approval:  "Approved",
+		Risk:      "Low",
+		MainConfigurationItem: MainConfigurationItem{
+			Name:   "payments-api",
+			Number: ConfigurationItemNumber{Identifier: "CI-42"},
+		},
+	}
+	if change != want {
+		t.Errorf("GetChange = %+v, want %+v", change, want)
+	}
+}
+
+func TestServiceNowGetChangeNotFound(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"result":[]}`)
+	}))
+	defer server.Close()
+	serviceNowConfig(t, server.URL, "", "change-user")
+
+	if _, err := newTestChangeManager(t).GetChange(context.Background(), "CHG0404"); err == nil {
+		t.Fatal("expected an error for a missing change request")
+	}
+}
+
+func TestServiceNowRejectsQueryInChangeNumber(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, changeRecord)
+	}))
+	defer server.Close()
+	serviceNowConfig(t, server.URL, "", "change-user")
+
+	manager := newTestChangeManager(t)
+	for _, snowId := range []string{"CHG0001^ORnumberISNOTEMPTY", "CHG0001^NQactive=true", "number=CHG0001", "CHG0001 ", "CHG%5E0001", ""} {
+		if _, err := manager.GetChange(context.Background(), snowId); err == nil || !strings.Contains(err.Error(), "is not a servicenow change number") {
+			t.Errorf("GetChange(%q) = %v, want the number rejected", snowId, err)
+		}
+		if err := manager.AddWorkNote(context.Background(), snowId, "deployed"); err == nil {
+			t.Errorf("AddWorkNote(%q) updated a change", snowId)
+		}
+	}
+	if sent := atomic.LoadInt32(&requests); sent != 0 {
+		t.Errorf("sent %d requests for invalid change numbers", sent)
+	}
+}
+
+func TestServiceNowOAuth(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		username  string
+		grantType string
+	}{
+		{"client credentials", "", "client_credentials"},
+		{"password grant", "change-user", "password"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tokens := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == serviceNowOAuthPath {
+					tokens++
+					if err := r.ParseForm(); err != nil {
+						t.Fatal(err)
+					}
+					if got := r.PostForm.Get("grant_type"); got != test.grantType {
+						t.Errorf("grant_type = %q, want %q", got, test.grantType)
+					}
+					if r.PostForm.Get("client_id") != "change-client" || r.PostForm.Get("client_secret") != "client-secret" {
+						t.Errorf("unexpected client credentials %v", r.PostForm)
+					}
+					if test.username != "" && (r.PostForm.Get("username") != test.username || r.PostForm.Get("password") != "change-password") {
+						t.Errorf("unexpected password grant %v", r.PostForm)
+					}
+					fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":1800}`, tokens)
+					return
+				}
+				// the first token is rejected once to exercise the refresh
+				if got := r.Header.Get("Authorization"); got != "Bearer token-2" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprint(w, changeRecord)
+			}))
+			defer server.Close()
+			serviceNowConfig(t, server.URL, "change-client", test.username)
+
+			manager := newTestChangeManager(t)
+			for i := 0; i < 2; i++ {
+				if _, err := manager.GetChange(context.Background(), "CHG0001"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tokens != 2 {
+				t.Errorf("requested %d tokens, want 2", tokens)
+			}
+		})
+	}
+}
+
+func TestServiceNowSetState(t *testing.T) {
+	saved := changeCloseCode
+	defer func() { changeCloseCode = saved }()
+	changeCloseCode = "successful"
+
+	var patched map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			fmt.Fprint(w, changeRecord)
+		case http.MethodPatch:
+			if r.URL.Path != serviceNowTablePath+"/abc123" || r.URL.Query().Get("sysparm_input_display_value") != "true" {
+				t.Errorf("unexpected patch %s", r.URL)
+			}
+			body, _ := io.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &patched); err != nil {
+				t.Fatal(err)
+			}
+			fmt.Fprint(w, `{"result":{"sys_id":"abc123"}}`)
+		}
+	}))
+	defer server.Close()
+	serviceNowConfig(t, server.URL, "", "change-user")
+
+	if err := newTestChangeManager(t).SetState(context.Background(), "CHG0001", "Review", "deployed"); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"state": "Review", "close_code": "successful", "close_notes": "deployed"}
+	if fmt.Sprint(patched) != fmt.Sprint(want) {
+		t.Errorf("patched %v, want %v", patched, want)
+	}
+}
+
+func TestServiceNowAuthConflict(t *testing.T) {
+	serviceNowConfig(t, "https://example.service-now.com", "", "change-user")
+	servicenowAuth = "type=bearer,token=abc"
+	if err := setupHTTPClients(); err == nil {
+		t.Fatal("expected servicenow-auth together with servicenow-username to fail")
+	}
+}
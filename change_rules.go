@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	allowedStateRule = "allowed-state"
+	timeWindowRule   = "time-window"
+	approvalRule     = "approval"
+	maxRiskRule      = "max-risk"
+	identifierRule   = "identifier"
+)
+
+var changeRulesFile string
+
+// changeRules is the rule set checkServiceNowStatus evaluates, loaded by loadChangeRules.
+var changeRules = defaultChangeRules()
+
+// ChangeRules declares when a change ticket allows a deployment.
+type ChangeRules struct {
+	// States lists the ticket states that allow a deployment, every other state fails.
+	States []ChangeStateRule `json:"states" yaml:"states"`
+	// RequiredApprovals lists the accepted values of the approval field, empty skips the check.
+	RequiredApprovals []string `json:"requiredApprovals" yaml:"requiredApprovals"`
+	// MaxRisk is the highest accepted risk, compared by its position in RiskLevels. Empty skips the check.
+	MaxRisk string `json:"maxRisk" yaml:"maxRisk"`
+	// RiskLevels orders the risk values from lowest to highest.
+	RiskLevels []string `json:"riskLevels" yaml:"riskLevels"`
+}
+
+type ChangeStateRule struct {
+	Name string `json:"name" yaml:"name"`
+	// RequireWindow only allows the deployment between the planned start and end of the change.
+	RequireWindow bool `json:"requireWindow" yaml:"requireWindow"`
+	// MatchIdentifier requires the configuration item identifier to match the application sealId and deploymentId.
+	MatchIdentifier bool `json:"matchIdentifier" yaml:"matchIdentifier"`
+}
+
+// ChangeRuleFailure names a rule a change ticket did not satisfy.
+type ChangeRuleFailure struct {
+	Rule    string
+	Message string
+}
+
+func (f ChangeRuleFailure) String() string {
+	return fmt.Sprintf("%s: %s", f.Rule, f.Message)
+}
+
+// defaultChangeRules lets "Implement" changes through and "Scheduled" ones only inside their
+// window and for the matching configuration item.
+func defaultChangeRules() ChangeRules {
+	return ChangeRules{
+		States: []ChangeStateRule{
+			{Name: "Implement"},
+			{Name: "Scheduled", RequireWindow: true, MatchIdentifier: true},
+		},
+		RiskLevels: []string{"Low", "Moderate", "High", "Very High"},
+	}
+}
+
+func loadChangeRules(path string) (ChangeRules, error) {
+	rules := defaultChangeRules()
+	if strings.TrimSpace(path) == "" {
+		return rules, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return ChangeRules{}, fmt.Errorf("error reading change rules file %s: %v", path, err)
+	}
+	var loaded ChangeRules
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&loaded); err != nil {
+		return ChangeRules{}, fmt.Errorf("error parsing change rules file %s: %v", path, err)
+	}
+	if len(loaded.States) == 0 {
+		return ChangeRules{}, fmt.Errorf("change rules file %s does not allow any state", path)
+	}
+	if len(loaded.RiskLevels) == 0 {
+		loaded.RiskLevels = rules.RiskLevels
+	}
+	if loaded.MaxRisk != "" && riskLevel(loaded.RiskLevels, loaded.MaxRisk) == -1 {
+		return ChangeRules{}, fmt.Errorf("maxRisk %q in change rules file %s is not one of %v", loaded.MaxRisk, path, loaded.RiskLevels)
+	}
+	return loaded, nil
+}
+
+// evaluateChangeRules returns every rule the change does not satisfy, an empty result allows the deployment.
+func evaluateChangeRules(rules ChangeRules, change ServiceNowResponse) []ChangeRuleFailure {
+	failures := make([]ChangeRuleFailure, 0)
+
+	var stateRule *ChangeStateRule
+	for i := range rules.States {
+		if strings.EqualFold(rules.States[i].Name, change.State) {
+			stateRule = &rules.States[i]
+		}
+	}
+	if stateRule == nil {
+		allowed := make([]string, 0, len(rules.States))
+		for _, state := range rules.States {
+			allowed = append(allowed, state.Name)
+		}
+		failures = append(failures, ChangeRuleFailure{Rule: allowedStateRule, Message: fmt.Sprintf("state %q is not one of %s", change.State, strings.Join(allowed, ", "))})
+	}
+
+	if len(rules.RequiredApprovals) > 0 && !containsFold(rules.RequiredApprovals, change.Approval) {
+		failures = append(failures, ChangeRuleFailure{Rule: approvalRule, Message: fmt.Sprintf("approval %q is not one of %s", change.Approval, strings.Join(rules.RequiredApprovals, ", "))})
+	}
+
+	if rules.MaxRisk != "" {
+		risk := riskLevel(rules.RiskLevels, change.Risk)
+		if risk == -1 || risk > riskLevel(rules.RiskLevels, rules.MaxRisk) {
+			failures = append(failures, ChangeRuleFailure{Rule: maxRiskRule, Message: fmt.Sprintf("risk %q is above the maximum %q", change.Risk, rules.MaxRisk)})
+		}
+	}
+
+	if stateRule == nil {
+		return failures
+	}
+
+	if stateRule.RequireWindow {
+		if message := checkChangeWindow(change); message != "" {
+			failures = append(failures, ChangeRuleFailure{Rule: timeWindowRule, Message: message})
+		}
+	}
+
+	if stateRule.MatchIdentifier {
+		sealIdFromResponse, deploymentIdFromResponse := parseIdentifierField(change)
+		if sealIdFromResponse != sealId {
+			failures = append(failures, ChangeRuleFailure{Rule: identifierRule, Message: fmt.Sprintf("seal id %q does not match %q", sealIdFromResponse, sealId)})
+		}
+		if deploymentIdFromResponse != deploymentId {
+			failures = append(failures, ChangeRuleFailure{Rule: identifierRule, Message: fmt.Sprintf("deployment id %q does not match %q", deploymentIdFromResponse, deploymentId)})
+		}
+	}
+	return failures
+}
+
+func riskLevel(levels []string, risk string) int {
+	for i, level := range levels {
+		if strings.EqualFold(level, strings.TrimSpace(risk)) {
+			return i
+		}
+	}
+	return -1
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, strings.TrimSpace(value)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var changeWorkNote bool
+var changeSuccessState, changeFailureState, changeCloseCode string
+
+// changeTransitionEnabled reports whether a sync hook has to update the validated change tickets.
+func changeTransitionEnabled(succeeded bool) bool {
+	if !changeValidationEnabled() {
+		return false
+	}
+	if succeeded {
+		return changeWorkNote || strings.TrimSpace(changeSuccessState) != ""
+	}
+	return changeWorkNote || strings.TrimSpace(changeFailureState) != ""
+}
+
+// transitionChangeTicket adds a work note describing the sync to the change ticket and moves it to
+// the configured success or failure state. Both updates are attempted even if the first one fails.
+func transitionChangeTicket(ctx context.Context, changeManager ChangeManager, snowId string, jobPayloads []JobPayload, succeeded bool) CheckResult {
+	started := time.Now()
+	state := changeSuccessState
+	if !succeeded {
+		state = changeFailureState
+	}
+	note := changeWorkNoteText(jobPayloads, succeeded)
+
+	var errs []error
+	done := make([]string, 0, 2)
+	if changeWorkNote {
+		if err := changeManager.AddWorkNote(ctx, snowId, note); err != nil {
+			errs = append(errs, err)
+		} else {
+			log.Printf("SUCCESS: Work note added to change %s", snowId)
+			done = append(done, "work note added")
+		}
+	}
+	if strings.TrimSpace(state) != "" {
+		if err := changeManager.SetState(ctx, snowId, state, note); err != nil {
+			errs = append(errs, err)
+		} else {
+			log.Printf("SUCCESS: Change %s moved to state %s", snowId, state)
+			done = append(done, "moved to "+state)
+		}
+	}
+
+	result := CheckResult{Check: changeTransitionCheck, Subject: snowId, Outcome: outcomePass, Message: strings.Join(done, ", "), Duration: time.Since(started)}
+	if err := errors.Join(errs...); err != nil {
+		log.Printf("ERROR: While updating change %s: %v", snowId, err)
+		result.Outcome = outcomeError
+		result.Message = strings.ReplaceAll(err.Error(), "\n", "; ")
+	}
+	return result
+}
+
+func changeWorkNoteText(jobPayloads []JobPayload, succeeded bool) string {
+	outcome := "succeeded"
+	if !succeeded {
+		outcome = "failed"
+	}
+	var note strings.Builder
+	fmt.Fprintf(&note, "Argo CD sync of application %s in namespace %s %s.\n", argocdAppName, argocdNamespace, outcome)
+	if strings.TrimSpace(targetEnvironment) != "" {
+		fmt.Fprintf(&note, "Target environment: %s\n", targetEnvironment)
+	}
+	if strings.TrimSpace(gitLastCommitId) != "" {
+		fmt.Fprintf(&note, "Revision: %s\n", gitLastCommitId)
+	}
+	if len(jobPayloads) > 0 {
+		note.WriteString("Images:\n")
+	}
+	for _, payload := range jobPayloads {
+		fmt.Fprintf(&note, "- %s:%s", payload.ArtifactName, payload.ArtifactTag)
+		if revision := firstNonEmpty(payload.CommitId, payload.Branch); revision != "" {
+			fmt.Fprintf(&note, " (revision %s)", revision)
+		}
+		note.WriteString("\n")
+	}
+	return note.String()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+var changeTimezone string
+var changeWindowEarlyGrace, changeWindowLateGrace, clockSkewTolerance time.Duration
+
+// clock returns the current time, tests replace it to evaluate change windows at a fixed instant.
+var clock = time.Now
+
+// changeLocation is the timezone of change timestamps that carry no offset, set by loadChangeLocation.
+var changeLocation = time.UTC
+
+// changeTimeLayouts are tried in order, ServiceNow returns "2006-01-02 15:04:05" in the instance timezone.
+var changeTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	serviceNowTimeLayout,
+	"2006-01-02 15:04",
+	"01/02/2006 15:04:05",
+	"02-01-2006 15:04:05",
+}
+
+func loadChangeLocation(name string) (*time.Location, error) {
+	if strings.TrimSpace(name) == "" {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid change-timezone %q: %v", name, err)
+	}
+	return location, nil
+}
+
+// parseChangeTime parses value with the first matching layout, timestamps without an offset are read in location.
+func parseChangeTime(value string, location *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range changeTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q does not match any of the layouts %s", value, strings.Join(changeTimeLayouts, ", "))
+}
+
+// checkChangeWindow returns why the current time is outside the change window, or "" when it is inside.
+// The window opens changeWindowEarlyGrace before the start and closes changeWindowLateGrace after the end,
+// both widened by clockSkewTolerance for the difference between this cluster and the ServiceNow instance.
+func checkChangeWindow(change ServiceNowResponse) string {
+	startTime, err := parseChangeTime(change.StartTime, changeLocation)
+	if err != nil {
+		return fmt.Sprintf("error parsing startTime: %v", err)
+	}
+	endTime, err := parseChangeTime(change.EndTime, changeLocation)
+	if err != nil {
+		return fmt.Sprintf("error parsing endTime: %v", err)
+	}
+	opens := startTime.Add(-changeWindowEarlyGrace - clockSkewTolerance)
+	closes := endTime.Add(changeWindowLateGrace + clockSkewTolerance)
+	current := clock().In(changeLocation)
+
+	window := fmt.Sprintf("window %s - %s", startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
+	if opens != startTime || closes != endTime {
+		window += fmt.Sprintf(" (with grace %s - %s)", opens.Format(time.RFC3339), closes.Format(time.RFC3339))
+	}
+	if current.Before(opens) {
+		return fmt.Sprintf("current time %s is before the %s, opens in %s", current.Format(time.RFC3339), window, opens.Sub(current).Round(time.Second))
+	}
+	if current.After(closes) {
+		return fmt.Sprintf("current time %s is after the %s, closed %s ago", current.Format(time.RFC3339), window, current.Sub(closes).Round(time.Second))
+	}
+	return ""
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// atTime evaluates change windows at now in location with the given grace, restoring the settings afterwards.
+func atTime(t *testing.T, now time.Time, location string, early, late, skew time.Duration) {
+	t.Helper()
+	savedClock, savedLocation := clock, changeLocation
+	savedEarly, savedLate, savedSkew := changeWindowEarlyGrace, changeWindowLateGrace, clockSkewTolerance
+	t.Cleanup(func() {
+		clock, changeLocation = savedClock, savedLocation
+		changeWindowEarlyGrace, changeWindowLateGrace, clockSkewTolerance = savedEarly, savedLate, savedSkew
+	})
+	loaded, err := loadChangeLocation(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock, changeLocation = func() time.Time { return now }, loaded
+	changeWindowEarlyGrace, changeWindowLateGrace, clockSkewTolerance = early, late, skew
+}
+
+func TestCheckChangeWindow(t *testing.T) {
+	window := ServiceNowResponse{StartTime: "2024-05-01 08:00:00", EndTime: "2024-05-01 12:00:00"}
+	utc := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	for _, test := range []struct {
+		name     string
+		now      time.Time
+		location string
+		early    time.Duration
+		late     time.Duration
+		skew     time.Duration
+		outside  string
+	}{
+		{name: "inside", now: utc("2024-05-01T10:00:00Z")},
+		{name: "at the start", now: utc("2024-05-01T08:00:00Z")},
+		{name: "at the end", now: utc("2024-05-01T12:00:00Z")},
+		{name: "just before the start", now: utc("2024-05-01T07:59:59Z"), outside: "before the window"},
+		{name: "just after the end", now: utc("2024-05-01T12:00:01Z"), outside: "after the window"},
+		{name: "next day", now: utc("2024-05-02T10:00:00Z"), outside: "closed 22h0m0s ago"},
+		{name: "early grace", now: utc("2024-05-01T07:45:00Z"), early: 15 * time.Minute},
+		{name: "before the early grace", now: utc("2024-05-01T07:44:59Z"), early: 15 * time.Minute, outside: "opens in 1s"},
+		{name: "late grace", now: utc("2024-05-01T12:30:00Z"), late: 30 * time.Minute},
+		{name: "clock skew widens both ends", now: utc("2024-05-01T07:58:00Z"), skew: 2 * time.Minute},
+		{name: "clock skew adds to the grace", now: utc("2024-05-01T12:32:00Z"), late: 30 * time.Minute, skew: 2 * time.Minute},
+		// the window is 08:00 - 12:00 in New York, which is 12:00 - 16:00 UTC during daylight saving time
+		{name: "timezone inside", now: utc("2024-05-01T14:00:00Z"), location: "America/New_York"},
+		{name: "timezone before", now: utc("2024-05-01T10:00:00Z"), location: "America/New_York", outside: "opens in 2h0m0s"},
+		{name: "timezone at the end", now: utc("2024-05-01T16:00:00Z"), location: "America/New_York"},
+		{name: "timezone after", now: utc("2024-05-01T16:00:01Z"), location: "America/New_York", outside: "after the window"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			atTime(t, test.now, test.location, test.early, test.late, test.skew)
+			got := checkChangeWindow(window)
+			if test.outside == "" && got != "" {
+				t.Errorf("expected to be inside the window, got %q", got)
+			}
+			if test.outside != "" && !strings.Contains(got, test.outside) {
+				t.Errorf("got %q, want it to contain %q", got, test.outside)
+			}
+		})
+	}
+}
+
+func TestCheckChangeWindowOffsets(t *testing.T) {
+	// timestamps with an offset ignore change-timezone
+	atTime(t, time.Date(2024, 5, 1, 6, 30, 0, 0, time.UTC), "Asia/Tokyo", 0, 0, 0)
+	window := ServiceNowResponse{StartTime: "2024-05-01T08:00:00+02:00", EndTime: "2024-05-01T09:00:00+02:00"}
+	if got := checkChangeWindow(window); got != "" {
+		t.Errorf("expected to be inside the window, got %q", got)
+	}
+}
+
+func TestCheckChangeWindowInvalid(t *testing.T) {
+	atTime(t, time.Now(), "", 0, 0, 0)
+	for _, window := range []ServiceNowResponse{
+		{StartTime: "tomorrow", EndTime: "2024-05-01 12:00:00"},
+		{StartTime: "2024-05-01 08:00:00", EndTime: ""},
+	} {
+		if got := checkChangeWindow(window); !strings.HasPrefix(got, "error parsing") {
+			t.Errorf("checkChangeWindow(%+v) = %q, want a parse error", window, got)
+		}
+	}
+}
+
+func TestLoadChangeLocation(t *testing.T) {
+	if location, err := loadChangeLocation(""); err != nil || location != time.UTC {
+		t.Errorf("loadChangeLocation(\"\") = %v, %v, want UTC", location, err)
+	}
+	if _, err := loadChangeLocation("Mars/Olympus_Mons"); err == nil {
+		t.Error("expected an error for an unknown timezone")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	outcomePass    = "pass"
+	outcomeFail    = "fail"
+	outcomeWarn    = "warn"
+	outcomeError   = "error"
+	outcomeSkipped = "skipped"
+)
+
+const (
+	releaseCheck          = "release-check"
+	regulationCheck       = "regulation"
+	serviceNowCheck       = "servicenow"
+	submitDeploymentCheck = "submit-deployment"
+	changeTransitionCheck = "change-transition"
+	localPolicyCheck      = "local-policy"
+	imagePolicyCheck      = "image-policy"
+	signatureCheck        = "signature"
+	provenanceCheck       = "provenance"
+)
+
+// CheckResult is the outcome of one check for one subject, such as the release check of an image
+// or the validation of a change ticket. Fail means the check ran and denied the deployment,
+// error means the check could not be evaluated. Url, Response and Links are optional details
+// for the machine-readable report.
+type CheckResult struct {
+	Check    string
+	Subject  string
+	Outcome  string
+	Message  string
+	Duration time.Duration
+	Url      string
+	Response string
+	Links    []string
+}
+
+// RunReport collects the results of every check of a run.
+type RunReport struct {
+	mu      sync.Mutex
+	results []CheckResult
+}
+
+// runReport is the report of the current run, printed as a summary by Execute.
+var runReport = &RunReport{}
+
+func (r *RunReport) Add(result CheckResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results = append(r.results, result)
+}
+
+func (r *RunReport) Results() []CheckResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]CheckResult{}, r.results...)
+}
+
+// Failed returns the results that block the deployment.
+func (r *RunReport) Failed() []CheckResult {
+	failed := make([]CheckResult, 0)
+	for _, result := range r.Results() {
+		if result.Outcome == outcomeFail || result.Outcome == outcomeError {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Err summarises the blocking results in one line, or returns nil when nothing blocks.
+func (r *RunReport) Err() error {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	reasons := make([]string, 0, len(failed))
+	for _, result := range failed {
+		reasons = append(reasons, fmt.Sprintf("%s %s %s", result.Check, result.Subject, result.Outcome))
+	}
+	return fmt.Errorf("%d of %d checks did not pass: %s", len(failed), len(r.Results()), strings.Join(reasons, ", "))
+}
+
+// Summary renders the results as a table.
+func (r *RunReport) Summary() string {
+	var buffer bytes.Buffer
+	w := tabwriter.NewWriter(&buffer, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tSUBJECT\tOUTCOME\tDURATION\tMESSAGE")
+	for _, result := range r.Results() {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", result.Check, result.Subject, strings.ToUpper(result.Outcome), result.Duration.Round(time.Millisecond), result.Message)
+	}
+	w.Flush()
+	return buffer.String()
+}
+
+// payloadSubject names an image and its JetId in results.
+func payloadSubject(payload JobPayload) string {
+	subject := payload.ArtifactName
+	if payload.ArtifactTag != "" {
+		subject += ":" + payload.ArtifactTag
+	}
+	if payload.JetId != "" {
+		subject += " (JetId " + payload.JetId + ")"
+	}
+	return subject
+}
+
+// collectResults adds every result sent on results to the run report until done is closed.
+func collectResults(results <-chan CheckResult, done <-chan bool) {
+	for {
+		select {
+		case result := <-results:
+			runReport.Add(result)
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	configFlag      = "config"
+	configEnvPrefix = "POLICY_JOB_"
+	flagSource      = "flag"
+	envSource       = "env"
+)
+
+var configFile string
+
+// sensitiveFlags are logged without their value when reporting where the configuration came from.
+var sensitiveFlags = map[string]bool{
+	"service-token":            true,
+	"servicenow-password":      true,
+	"servicenow-client-secret": true,
+	"release-check-auth":       true,
+	"servicenow-auth":          true,
+	"submit-deployment-auth":   true,
+}
+
+// loadConfiguration fills every flag not given on the command line from a POLICY_JOB_<FLAG>
+// environment variable or else from the --config file, so flags win over the environment and the
+// environment over the file. The file is yaml or json keyed by flag name, lists are given for
+// repeatable flags. Unknown keys in the file fail the run, unknown variables only warn, and the
+// source of every value is logged.
+func loadConfiguration(cmd *cobra.Command) error {
+	known := make(map[string]bool)
+	collectFlagNames(cmd.Root(), known)
+	sources := make(map[string]string)
+
+	path := configFile
+	if !cmd.Flags().Changed(configFlag) {
+		if value, ok := os.LookupEnv(envName(configFlag)); ok {
+			path = value
+		}
+	}
+	values, err := readConfigFile(path, known)
+	if err != nil {
+		return err
+	}
+	env := readConfigEnv(known)
+
+	var errs []string
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		if flag.Name == configFlag {
+			return
+		}
+		if flag.Changed {
+			sources[flag.Name] = flagSource
+			return
+		}
+		var items []string
+		if value, ok := env[flag.Name]; ok {
+			items, sources[flag.Name] = envValues(flag, value), envSource+" "+envName(flag.Name)
+		} else if value, ok := values[flag.Name]; ok {
+			items, sources[flag.Name] = value, configFlag+" "+path
+		} else {
+			return
+		}
+		if err := setFlag(flag, items); err != nil {
+			errs = append(errs, fmt.Sprintf("%s from %s: %v", flag.Name, sources[flag.Name], err))
+		}
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(errs, "; "))
+	}
+	logConfiguration(cmd, sources)
+	return nil
+}
+
+// collectFlagNames gathers the flags of every command, so a file or environment shared by all
+// commands is valid for each of them.
+func collectFlagNames(cmd *cobra.Command, known map[string]bool) {
+	add := func(flag *pflag.Flag) { known[flag.Name] = true }
+	cmd.Flags().VisitAll(add)
+	cmd.PersistentFlags().VisitAll(add)
+	for _, child := range cmd.Commands() {
+		collectFlagNames(child, known)
+	}
+	delete(known, configFlag)
+	delete(known, "help")
+}
+
+// readConfigFile reads the --config file into flag name to values.
+func readConfigFile(path string, known map[string]bool) (map[string][]string, error) {
+	values := make(map[string][]string)
+	if strings.TrimSpace(path) == "" {
+		return values, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config file %s: %v", path, err)
+	}
+	// decoded into a generic map rather than a struct, so every unknown key can be reported at once
+	// and each value is handed to its flag as text, letting the flag parse it like on the command line
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %v", path, err)
+	}
+
+	var unknown, invalid []string
+	for key, value := range raw {
+		if !known[key] {
+			unknown = append(unknown, key)
+			continue
+		}
+		switch v := value.(type) {
+		case nil:
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				if !isScalar(item) {
+					invalid = append(invalid, key)
+					break
+				}
+				items = append(items, fmt.Sprint(item))
+			}
+			values[key] = items
+		default:
+			if !isScalar(v) {
+				invalid = append(invalid, key)
+				continue
+			}
+			values[key] = []string{fmt.Sprint(v)}
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("config file %s has unknown keys: %s", path, strings.Join(unknown, ", "))
+	}
+	if len(invalid) > 0 {
+		sort.Strings(invalid)
+		return nil, fmt.Errorf("config file %s: %s should be a value or a list of values", path, strings.Join(invalid, ", "))
+	}
+	return values, nil
+}
+
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case string, bool, int, int64, uint64, float64:
+		return true
+	}
+	return false
+}
+
+// readConfigEnv reads the POLICY_JOB_<FLAG> variables into flag name to value. Other POLICY_JOB_
+// variables only warn, kubernetes sets POLICY_JOB_SERVICE_* and POLICY_JOB_PORT* in every pod of the
+// namespace when a service named policy-job exists, those are skipped quietly.
+func readConfigEnv(known map[string]bool) map[string]string {
+	names := make(map[string]string, len(known))
+	for name := range known {
+		names[envName(name)] = name
+	}
+	env := make(map[string]string)
+	var unknown []string
+	for _, entry := range os.Environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		if !strings.HasPrefix(key, configEnvPrefix) || key == envName(configFlag) {
+			continue
+		}
+		name, ok := names[key]
+		if !ok {
+			if !isServiceLinkVariable(key) {
+				unknown = append(unknown, key)
+			}
+			continue
+		}
+		env[name] = value
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		log.Printf("WARNING: ignoring environment variables that match no flag: %s", strings.Join(unknown, ", "))
+	}
+	return env
+}
+
+// isServiceLinkVariable reports whether key is one of the variables kubernetes injects for a
+// service named policy-job, such as POLICY_JOB_SERVICE_HOST or POLICY_JOB_PORT_8080_TCP_ADDR.
+func isServiceLinkVariable(key string) bool {
+	suffix := strings.TrimPrefix(key, configEnvPrefix)
+	return suffix == "SERVICE_HOST" || strings.HasPrefix(suffix, "SERVICE_PORT") || suffix == "PORT" || strings.HasPrefix(suffix, "PORT_")
+}
+
+// envName maps a flag to its variable, e.g. release-check-url to POLICY_JOB_RELEASE_CHECK_URL.
+func envName(flag string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// envValues splits the variable of a repeatable flag given as a json list, e.g. ["a","b"].
+func envValues(flag *pflag.Flag, value string) []string {
+	if _, ok := flag.Value.(pflag.SliceValue); ok && strings.HasPrefix(strings.TrimSpace(value), "[") {
+		var items []string
+		if err := json.Unmarshal([]byte(value), &items); err == nil {
+			return items
+		}
+	}
+	return []string{value}
+}
+
+func setFlag(flag *pflag.Flag, items []string) error {
+	if slice, ok := flag.Value.(pflag.SliceValue); ok {
+		if err := slice.Replace(items); err != nil {
+			return err
+		}
+	} else {
+		if len(items) != 1 {
+			return fmt.Errorf("takes a single value, not a list")
+		}
+		if err := flag.Value.Set(items[0]); err != nil {
+			return err
+		}
+	}
+	flag.Changed = true
+	return nil
+}
+
+// logConfiguration logs every flag that is not at its default together with where it came from.
+func logConfiguration(cmd *cobra.Command, sources map[string]string) {
+	var lines []string
+	cmd.Flags().VisitAll(func(flag *pflag.Flag) {
+		source, ok := sources[flag.Name]
+		if !ok {
+			return
+		}
+		value := flag.Value.String()
+		if sensitiveFlags[flag.Name] {
+			value = redactedSecret
+		}
+		lines = append(lines, fmt.Sprintf("  %s=%s (%s)", flag.Name, value, source))
+	})
+	if len(lines) > 0 {
+		log.Printf("Configuration:\n%s", strings.Join(lines, "\n"))
+	}
+}
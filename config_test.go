@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// testConfig holds the flags of the command built by newConfigTestCommand.
+type testConfig struct {
+	url      string
+	retries  int
+	verify   bool
+	keys     []string
+	token    string
+	spoolDir string
+}
+
+// newConfigTestCommand builds a root command with a flush subcommand, like main, with its own flags
+// so the tests do not touch the real ones.
+func newConfigTestCommand(t *testing.T) (*cobra.Command, *testConfig) {
+	t.Helper()
+	saved := configFile
+	t.Cleanup(func() { configFile = saved })
+	configFile = ""
+
+	config := &testConfig{}
+	root := &cobra.Command{Use: "policy-job"}
+	root.PersistentFlags().StringVarP(&configFile, configFlag, "", "", "config file")
+	root.PersistentFlags().StringVarP(&config.token, "service-token", "", "", "service token")
+	root.Flags().StringVarP(&config.url, "release-check-url", "", "", "release check url")
+	root.Flags().IntVarP(&config.retries, "retries", "", 3, "retries")
+	root.Flags().BoolVarP(&config.verify, "verify-signatures", "", false, "verify signatures")
+	root.Flags().StringSliceVarP(&config.keys, "cosign-key", "", nil, "cosign keys")
+	flush := &cobra.Command{Use: "flush"}
+	flush.Flags().StringVarP(&config.spoolDir, "spool-dir", "", "", "spool directory")
+	root.AddCommand(flush)
+	return root, config
+}
+
+// captureLog returns what is logged during the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buffer bytes.Buffer
+	log.SetOutput(&buffer)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buffer
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy-job.yaml")
+	writeFile(t, path, []byte(content))
+	return path
+}
+
+func TestLoadConfigurationPrecedence(t *testing.T) {
+	file := `
+release-check-url: https://file.example.com
+retries: 5
+verify-signatures: true
+cosign-key: [/keys/file-a.pub, /keys/file-b.pub]
+spool-dir: /spool
+`
+	for _, test := range []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		url     string
+		retries int
+		keys    string
+		source  string
+	}{
+		{
+			name:    "file",
+			url:     "https://file.example.com",
+			retries: 5,
+			keys:    "/keys/file-a.pub,/keys/file-b.pub",
+			source:  "release-check-url=https://file.example.com (config ",
+		},
+		{
+			name:    "environment over file",
+			env:     map[string]string{"POLICY_JOB_RELEASE_CHECK_URL": "https://env.example.com", "POLICY_JOB_COSIGN_KEY": `["/keys/env.pub"]`},
+			url:     "https://env.example.com",
+			retries: 5,
+			keys:    "/keys/env.pub",
+			source:  "release-check-url=https://env.example.com (env POLICY_JOB_RELEASE_CHECK_URL)",
+		},
+		{
+			name:    "environment value that is not a json list is a single item",
+			env:     map[string]string{"POLICY_JOB_COSIGN_KEY": "/keys/a.pub"},
+			url:     "https://file.example.com",
+			retries: 5,
+			keys:    "/keys/a.pub",
+			source:  "cosign-key=[/keys/a.pub] (env POLICY_JOB_COSIGN_KEY)",
+		},
+		{
+			name:    "flag over environment and file",
+			args:    []string{"--release-check-url=https://flag.example.com", "--cosign-key=/keys/flag.pub"},
+			env:     map[string]string{"POLICY_JOB_RELEASE_CHECK_URL": "https://env.example.com", "POLICY_JOB_RETRIES": "7"},
+			url:     "https://flag.example.com",
+			retries: 7,
+			keys:    "/keys/flag.pub",
+			source:  "release-check-url=https://flag.example.com (flag)",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			output := captureLog(t)
+			cmd, config := newConfigTestCommand(t)
+			if err := cmd.ParseFlags(append([]string{"--config", writeConfig(t, file)}, test.args...)); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadConfiguration(cmd); err != nil {
+				t.Fatal(err)
+			}
+			if config.url != test.url || config.retries != test.retries || !config.verify || strings.Join(config.keys, ",") != test.keys {
+				t.Errorf("got url %q, retries %d, verify %v, keys %v", config.url, config.retries, config.verify, config.keys)
+			}
+			if !strings.Contains(output.String(), test.source) {
+				t.Errorf("logged configuration %q does not contain %q", output.String(), test.source)
+			}
+		})
+	}
+}
+
+func TestLoadConfigurationFileFromEnvironment(t *testing.T) {
+	t.Setenv("POLICY_JOB_CONFIG", writeConfig(t, "retries: 8\n"))
+	cmd, config := newConfigTestCommand(t)
+	if err := loadConfiguration(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if config.retries != 8 {
+		t.Errorf("retries %d, want 8 from the file named by POLICY_JOB_CONFIG", config.retries)
+	}
+
+	// --config wins over POLICY_JOB_CONFIG
+	cmd, config = newConfigTestCommand(t)
+	if err := cmd.ParseFlags([]string{"--config", writeConfig(t, "retries: 9\n")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfiguration(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if config.retries != 9 {
+		t.Errorf("retries %d, want 9 from --config", config.retries)
+	}
+}
+
+func TestLoadConfigurationErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		file string
+		env  map[string]string
+		want string
+	}{
+		{"unknown keys", "release-check-url: https://file.example.com\nretry: 5\nverify: true\n", nil, "has unknown keys: retry, verify"},
+		{"help is not a key", "help: true\n", nil, "has unknown keys: help"},
+		{"map value", "release-check-url:\n  host: file.example.com\n", nil, "release-check-url should be a value or a list of values"},
+		{"list of maps", "cosign-key:\n  - path: /keys/a.pub\n", nil, "cosign-key should be a value or a list of values"},
+		{"list for a single value", "release-check-url: [https://a.example.com, https://b.example.com]\n", nil, "release-check-url from config"},
+		{"invalid value in the file", "retries: many\n", nil, "retries from config"},
+		{"invalid value in the environment", "retries: 5\n", map[string]string{"POLICY_JOB_RETRIES": "many"}, "retries from env POLICY_JOB_RETRIES"},
+		{"invalid yaml", "retries: [5\n", nil, "error parsing config file"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for key, value := range test.env {
+				t.Setenv(key, value)
+			}
+			cmd, _ := newConfigTestCommand(t)
+			if err := cmd.ParseFlags([]string{"--config", writeConfig(t, test.file)}); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadConfiguration(cmd); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("got %v, want an error containing %q", err, test.want)
+			}
+		})
+	}
+
+	cmd, _ := newConfigTestCommand(t)
+	if err := cmd.ParseFlags([]string{"--config", filepath.Join(t.TempDir(), "missing.yaml")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfiguration(cmd); err == nil || !strings.Contains(err.Error(), "error reading config file") {
+		t.Errorf("missing config file: %v", err)
+	}
+}
+
+func TestLoadConfigurationWarnsAboutUnknownVariables(t *testing.T) {
+	for key, value := range map[string]string{
+		"POLICY_JOB_RELEASE_CHEK_URL":        "https://typo.example.com",
+		"POLICY_JOB_SERVICE_HOST":            "10.0.0.12",
+		"POLICY_JOB_SERVICE_PORT":            "8080",
+		"POLICY_JOB_SERVICE_PORT_HTTP":       "8080",
+		"POLICY_JOB_PORT":                    "tcp://10.0.0.12:8080",
+		"POLICY_JOB_PORT_8080_TCP_ADDR":      "10.0.0.12",
+		"POLICY_JOB_SPOOL_DIR":               "/spool",
+		"POLICY_JOB_SERVICE_TOKEN":           "env-secret-token",
+		"POLICY_JOB_SERVICE_ACCOUNT_NAMESPC": "typo",
+	} {
+		t.Setenv(key, value)
+	}
+	output := captureLog(t)
+	cmd, config := newConfigTestCommand(t)
+	if err := cmd.ParseFlags(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfiguration(cmd); err != nil {
+		t.Fatal(err)
+	}
+	logged := output.String()
+	if !strings.Contains(logged, "WARNING: ignoring environment variables that match no flag: POLICY_JOB_RELEASE_CHEK_URL, POLICY_JOB_SERVICE_ACCOUNT_NAMESPC\n") {
+		t.Errorf("expected a warning for the unknown variables only, logged %q", logged)
+	}
+	// spool-dir is a flag of the flush subcommand, the variable is known but does not apply here
+	if config.spoolDir != "" || strings.Contains(logged, "spool-dir") {
+		t.Errorf("spool-dir of the flush command was set on the root command: %q", config.spoolDir)
+	}
+	if config.token != "env-secret-token" || strings.Contains(logged, "env-secret-token") || !strings.Contains(logged, "service-token="+redactedSecret) {
+		t.Errorf("service-token %q, logged %q", config.token, logged)
+	}
+}
+
+func TestIsServiceLinkVariable(t *testing.T) {
+	for key, want := range map[string]bool{
+		"POLICY_JOB_SERVICE_HOST":           true,
+		"POLICY_JOB_SERVICE_PORT":           true,
+		"POLICY_JOB_SERVICE_PORT_METRICS":   true,
+		"POLICY_JOB_PORT":                   true,
+		"POLICY_JOB_PORT_8080_TCP":          true,
+		"POLICY_JOB_PORT_8080_TCP_PROTO":    true,
+		"POLICY_JOB_SERVICE_TOKEN":          false,
+		"POLICY_JOB_SERVICE_TOKEN_FROM":     false,
+		"POLICY_JOB_SERVICENOW_URL":         false,
+		"POLICY_JOB_PORTAL_URL":             false,
+		"POLICY_JOB_RELEASE_CHECK_URL":      false,
+		"POLICY_JOB_SUBMIT_DEPLOYMENT_AUTH": false,
+	} {
+		if got := isServiceLinkVariable(key); got != want {
+			t.Errorf("isServiceLinkVariable(%s) = %v, want %v", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	fileCredentialSource   = "file"
+	envCredentialSource    = "env"
+	secretCredentialSource = "secret"
+	redactedSecret         = "[REDACTED]"
+	minRedactedLength      = 4
+)
+
+// Credential is a secret passed as a flag or, so it stays out of pod specs and process listings,
+// read from a file, an environment variable or a Kubernetes Secret as given by its -from flag.
+// A file is read again on every use, so a rotated secret is picked up without a restart.
+type Credential struct {
+	flag   string
+	value  string
+	source string
+
+	mu       sync.Mutex
+	file     string
+	resolved string
+}
+
+var serviceToken = &Credential{flag: "service-token"}
+var serviceNowPassword = &Credential{flag: "servicenow-password"}
+var serviceNowClientSecret = &Credential{flag: "servicenow-client-secret"}
+
+// flagCredentials are the credentials with flags of their own, the --<endpoint>-auth flags add theirs
+// to credentials in setupHTTPClients.
+var flagCredentials = []*Credential{serviceToken, serviceNowPassword, serviceNowClientSecret}
+
+// credentials lists every credential loadCredentials resolves.
+var credentials = flagCredentials
+
+// loadCredentials resolves the -from flag of every credential once at startup, so a missing
+// file, variable or secret fails the run before any check starts.
+func loadCredentials(ctx context.Context) error {
+	var kubeClient *KubeClient
+	for _, credential := range credentials {
+		registerSecret(credential.value)
+		if strings.TrimSpace(credential.source) == "" {
+			continue
+		}
+		kind, ref, _ := strings.Cut(credential.source, ":")
+		switch kind {
+		case fileCredentialSource:
+			credential.file = ref
+			if _, err := credential.readFile(); err != nil {
+				return fmt.Errorf("error reading %s from file: %v", credential.flag, err)
+			}
+		case envCredentialSource:
+			value := strings.TrimSpace(os.Getenv(ref))
+			if value == "" {
+				return fmt.Errorf("environment variable %s for %s is not set", ref, credential.flag)
+			}
+			credential.resolved = value
+		case secretCredentialSource:
+			if kubeClient == nil {
+				client, err := NewKubeClient()
+				if err != nil {
+					return fmt.Errorf("error while creating kubernetes client to read %s: %v", credential.flag, err)
+				}
+				kubeClient = client
+			}
+			value, err := readSecretKey(ctx, kubeClient, ref)
+			if errors.Is(err, ErrForbidden) {
+				return fmt.Errorf("error reading %s from secret %s: %v, apply manifests/policy-job-secret-reader-role.yaml with the secret in its resourceNames", credential.flag, ref, err)
+			}
+			if err != nil {
+				return fmt.Errorf("error reading %s from secret %s: %v", credential.flag, ref, err)
+			}
+			credential.resolved = value
+		default:
+			return fmt.Errorf("%s-from %q should be file:<path>, env:<variable> or secret:[<namespace>/]<name>/<key>", credential.flag, credential.source)
+		}
+		registerSecret(credential.resolved)
+	}
+	return nil
+}
+
+// readSecretKey reads a key of a Secret given as [<namespace>/]<name>/<key>, defaulting to argocd-namespace.
+func readSecretKey(ctx context.Context, client *KubeClient, ref string) (string, error) {
+	parts := strings.Split(ref, "/")
+	namespace := argocdNamespace
+	if len(parts) == 3 {
+		namespace, parts = parts[0], parts[1:]
+	}
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("secret reference should be [<namespace>/]<name>/<key>")
+	}
+	secret, err := client.GetSecret(ctx, namespace, parts[0])
+	if err != nil {
+		return "", err
+	}
+	encoded, ok := secret.Data[parts[1]]
+	if !ok {
+		return "", fmt.Errorf("secret has no key %s", parts[1])
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("key %s is not base64 encoded: %v", parts[1], err)
+	}
+	value := strings.TrimSpace(string(decoded))
+	if value == "" {
+		return "", fmt.Errorf("key %s is empty", parts[1])
+	}
+	return value, nil
+}
+
+func (c *Credential) readFile() (string, error) {
+	content, err := os.ReadFile(c.file)
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return "", fmt.Errorf("file %s is empty", c.file)
+	}
+	c.mu.Lock()
+	c.resolved = value
+	c.mu.Unlock()
+	registerSecret(value)
+	return value, nil
+}
+
+// Value returns the current secret. A file that cannot be read anymore keeps the last value.
+func (c *Credential) Value() string {
+	if c.file != "" {
+		value, err := c.readFile()
+		if err == nil {
+			return value
+		}
+		log.Printf("WARNING: could not re-read %s from %s, using the last value: %v", c.flag, c.file, err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resolved != "" {
+		return c.resolved
+	}
+	return c.value
+}
+
+// IsSet reports whether the credential has a value.
+func (c *Credential) IsSet() bool {
+	return c.Value() != ""
+}
+
+// secrets holds every secret value seen, longest first, so they can be removed from output.
+var secrets struct {
+	mu     sync.RWMutex
+	values []string
+}
+
+// registerSecret makes redactSecrets remove value from now on.
+func registerSecret(value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < minRedactedLength {
+		return
+	}
+	secrets.mu.Lock()
+	defer secrets.mu.Unlock()
+	for _, known := range secrets.values {
+		if known == value {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, value)
+	sort.Slice(secrets.values, func(i, j int) bool {
+		return len(secrets.values[i]) > len(secrets.values[j])
+	})
+}
+
+// redactSecrets replaces every registered secret in s.
+func redactSecrets(s string) string {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	for _, value := range secrets.values {
+		s = strings.ReplaceAll(s, value, redactedSecret)
+	}
+	return s
+}
+
+// redactingWriter removes registered secrets from everything written through it, it is the output
+// of the log package and of cobra so no log line or error can leak a secret.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redactSecrets(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
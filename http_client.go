@@ -1,20 +1,238 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
 	"net/http"
+	"strconv"
 	"time"
 )
 
-var httpClient *http.Client
+const (
+	releaseCheckEndpoint     = "release-check"
+	servicenowEndpoint       = "servicenow"
+	submitDeploymentEndpoint = "submit-deployment"
+	registryEndpoint         = "registry"
+	maxRetryAfter            = 5 * time.Minute
+)
+
+var releaseCheckClient, serviceNowClient, submitDeploymentClient, registryClient *http.Client
+
+var releaseCheckMaxRetries, servicenowMaxRetries, submitDeploymentMaxRetries int
+var retryBaseDelay, retryMaxDelay time.Duration
+
+// RetryPolicy bounds how often and how long a retryTransport retries a request.
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// EndpointOptions configures the client of one outbound endpoint.
+type EndpointOptions struct {
+	Retry             RetryPolicy
+	Transport         TransportOptions
+	Auth              Authenticator
+	ClientCertificate *clientCertificate
+}
+
+// serviceTokenEndpoints are the endpoints that authenticate with the service token.
+var serviceTokenEndpoints = make(map[string]bool)
+
+// requireServiceToken fails when one of the endpoints a run calls needs the service token and it is not set.
+func requireServiceToken(endpoints ...string) error {
+	for _, endpoint := range endpoints {
+		if serviceTokenEndpoints[endpoint] && !serviceToken.IsSet() {
+			return fmt.Errorf("service-token or service-token-from flag has to be set, the %s endpoint authenticates with it", endpoint)
+		}
+	}
+	return nil
+}
 
-func init() {
-	//TODO: This may have to be changed in the future
-	httpClient = NewHTTPClient(timeout)
+// setupHTTPClients builds one client per endpoint from the parsed flags, each with its own retry limit
+// and authentication. The servicenow endpoint only sends the OpsMx header to the OpsMx proxy, for
+// the ServiceNow table api it takes its authentication from serviceNowTableAuth.
+func setupHTTPClients() error {
+	servicenowDefaultAuth := opsmxAuth
+	if changeBackend == serviceNowChangeBackend {
+		servicenowDefaultAuth = noAuth
+	}
+	endpoints := []struct {
+		client      **http.Client
+		endpoint    string
+		maxRetries  int
+		transport   string
+		auth        string
+		defaultAuth string
+	}{
+		{&releaseCheckClient, releaseCheckEndpoint, releaseCheckMaxRetries, releaseCheckTransport, releaseCheckAuth, opsmxAuth},
+		{&serviceNowClient, servicenowEndpoint, servicenowMaxRetries, servicenowTransport, servicenowAuth, servicenowDefaultAuth},
+		{&submitDeploymentClient, submitDeploymentEndpoint, submitDeploymentMaxRetries, submitDeploymentTransport, submitDeploymentAuth, opsmxAuth},
+		{&registryClient, registryEndpoint, registryMaxRetries, registryTransport, "", noAuth},
+	}
+	serviceTokenEndpoints = make(map[string]bool)
+	credentials = append([]*Credential{}, flagCredentials...)
+	for _, e := range endpoints {
+		options := EndpointOptions{
+			Retry:     RetryPolicy{MaxRetries: e.maxRetries, BaseDelay: retryBaseDelay, MaxDelay: retryMaxDelay},
+			Transport: defaultTransport,
+		}
+		if err := parseTransportSpec(e.endpoint, e.transport, &options.Transport); err != nil {
+			return err
+		}
+		if err := parseAuthSpec(e.endpoint, e.auth, e.defaultAuth, &options); err != nil {
+			return err
+		}
+		if e.endpoint == servicenowEndpoint && changeBackend == serviceNowChangeBackend {
+			if err := serviceNowTableAuth(&options); err != nil {
+				return err
+			}
+		}
+		if oauth2, ok := options.Auth.(*oauth2Authenticator); ok {
+			tokenClient, err := NewHTTPClient(e.endpoint+" token", EndpointOptions{Retry: options.Retry, Transport: options.Transport, ClientCertificate: options.ClientCertificate})
+			if err != nil {
+				return err
+			}
+			oauth2.httpClient = tokenClient
+		}
+		client, err := NewHTTPClient(e.endpoint, options)
+		if err != nil {
+			return err
+		}
+		*e.client = client
+	}
+	return nil
 }
 
-func NewHTTPClient(clientTimeout int) *http.Client {
+func NewHTTPClient(endpoint string, options EndpointOptions) (*http.Client, error) {
+	transport, err := newTransport(endpoint, options.Transport, options.ClientCertificate)
+	if err != nil {
+		return nil, err
+	}
+	var next http.RoundTripper = transport
+	if options.Auth != nil {
+		next = &authTransport{next: next, auth: options.Auth}
+	}
 	return &http.Client{
-		Timeout: time.Duration(clientTimeout) * time.Second,
+		Timeout: options.Transport.RequestTimeout,
+		Transport: &retryTransport{
+			next:     next,
+			endpoint: endpoint,
+			policy:   options.Retry,
+		},
+	}, nil
+}
+
+// retryTransport retries requests that failed on the network or with a 5xx/429 response, using capped
+// exponential backoff with jitter and honouring Retry-After. Network errors are only retried for
+// idempotent requests, since a non-idempotent request might already have reached the server.
+type retryTransport struct {
+	next     http.RoundTripper
+	endpoint string
+	policy   RetryPolicy
+}
+
+func (t *retryTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		attemptRequest := request
+		if attempt > 0 && request.Body != nil {
+			if request.GetBody == nil {
+				return nil, fmt.Errorf("cannot retry %s %s, request body cannot be replayed", request.Method, request.URL.Redacted())
+			}
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptRequest = request.Clone(request.Context())
+			attemptRequest.Body = body
+		}
+
+		resp, err := t.next.RoundTrip(attemptRequest)
+		reason, retryable := retryReason(request, resp, err)
+		if !retryable || attempt >= t.policy.MaxRetries {
+			return resp, err
+		}
+
+		delay := backoffDelay(t.policy, attempt)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+				delay = retryAfter
+			}
+			// drain the body so the connection can be reused by the next attempt
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		log.Printf("%s: %s %s failed with %s, retry %d/%d in %s", t.endpoint, request.Method, request.URL.Redacted(), reason, attempt+1, t.policy.MaxRetries, delay.Round(time.Millisecond))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-request.Context().Done():
+			timer.Stop()
+			return nil, request.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// retryReason reports why an attempt should be retried.
+func retryReason(request *http.Request, resp *http.Response, err error) (string, bool) {
+	if err != nil {
+		if request.Context().Err() != nil {
+			return "", false
+		}
+		return err.Error(), isIdempotent(request)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return resp.Status, true
+	}
+	return "", false
+}
+
+func isIdempotent(request *http.Request) bool {
+	switch request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
 	}
+	return request.Header.Get("Idempotency-Key") != ""
+}
+
+// backoffDelay doubles the base delay per attempt up to the maximum, where a maximum of 0 means no
+// bound, and picks a random delay in its upper half.
+func backoffDelay(policy RetryPolicy, attempt int) time.Duration {
+	delay := policy.BaseDelay
+	for i := 0; i < attempt && (policy.MaxDelay <= 0 || delay < policy.MaxDelay) && delay <= math.MaxInt64/2; i++ {
+		delay *= 2
+	}
+	if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
 
+// parseRetryAfter reads a Retry-After header given either in seconds or as an http date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = time.Until(date)
+	} else {
+		return 0, false
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	return delay, true
 }
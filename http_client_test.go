@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, policy RetryPolicy) *http.Client {
+	t.Helper()
+	client, err := NewHTTPClient("test", EndpointOptions{Retry: policy, Transport: defaultTransport})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// failingServer answers the first failures requests with status and counts every request.
+func failingServer(failures int32, status int, header http.Header) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return server, &requests
+}
+
+func TestRetryOnServerErrors(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusTooManyRequests} {
+		server, requests := failingServer(2, status, nil)
+		defer server.Close()
+
+		resp, err := newTestClient(t, RetryPolicy{MaxRetries: 3, BaseDelay: time.Millisecond}).Get(server.URL)
+		if err != nil {
+			t.Fatalf("%d: %v", status, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || atomic.LoadInt32(requests) != 3 {
+			t.Errorf("%d: got %d after %d requests, want 200 after 3", status, resp.StatusCode, atomic.LoadInt32(requests))
+		}
+	}
+}
+
+func TestNoRetryOnClientErrors(t *testing.T) {
+	server, requests := failingServer(1, http.StatusBadRequest, nil)
+	defer server.Close()
+
+	resp, err := newTestClient(t, RetryPolicy{MaxRetries: 3, BaseDelay: time.Millisecond}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || atomic.LoadInt32(requests) != 1 {
+		t.Errorf("got %d after %d requests, want 400 after 1", resp.StatusCode, atomic.LoadInt32(requests))
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	server, requests := failingServer(1, http.StatusServiceUnavailable, http.Header{"Retry-After": {"0"}})
+	defer server.Close()
+
+	// the backoff alone would outlast the test, so finishing shows Retry-After was used
+	client := newTestClient(t, RetryPolicy{MaxRetries: 1, BaseDelay: time.Hour, MaxDelay: time.Hour})
+	start := time.Now()
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || atomic.LoadInt32(requests) != 2 {
+		t.Errorf("got %d after %d requests, want 200 after 2", resp.StatusCode, atomic.LoadInt32(requests))
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("retry took %s, Retry-After 0 was not honoured", elapsed)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"soon", 0, false},
+		{"3", 3 * time.Second, true},
+		{"-5", 0, true},
+		{"86400", maxRetryAfter, true},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+	} {
+		got, ok := parseRetryAfter(test.value)
+		if got != test.want || ok != test.ok {
+			t.Errorf("parseRetryAfter(%q) = %s, %v, want %s, %v", test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestRetryBudgetExhausted(t *testing.T) {
+	server, requests := failingServer(100, http.StatusServiceUnavailable, nil)
+	defer server.Close()
+
+	resp, err := newTestClient(t, RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || atomic.LoadInt32(requests) != 3 {
+		t.Errorf("got %d after %d requests, want the last 503 after 3", resp.StatusCode, atomic.LoadInt32(requests))
+	}
+}
+
+// droppingServer closes every connection without answering, which the client sees as a network error.
+func droppingServer(t *testing.T) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	return server, &requests
+}
+
+func TestNetworkErrorRetriedOnlyWhenIdempotent(t *testing.T) {
+	for _, test := range []struct {
+		name           string
+		method         string
+		idempotencyKey string
+		want           int32
+	}{
+		{"get", http.MethodGet, "", 3},
+		{"post", http.MethodPost, "", 1},
+		{"post with idempotency key", http.MethodPost, "run-1", 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server, requests := droppingServer(t)
+			defer server.Close()
+
+			request, err := http.NewRequest(test.method, server.URL, strings.NewReader("{}"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.idempotencyKey != "" {
+				request.Header.Set("Idempotency-Key", test.idempotencyKey)
+			}
+			if _, err := newTestClient(t, RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond}).Do(request); err == nil {
+				t.Fatal("expected a network error")
+			}
+			if atomic.LoadInt32(requests) != test.want {
+				t.Errorf("sent %d requests, want %d", atomic.LoadInt32(requests), test.want)
+			}
+		})
+	}
+}
+
+func TestSetupHTTPClientsDoesNotDuplicateCredentials(t *testing.T) {
+	savedAuth, savedCredentials, savedEndpoints := releaseCheckAuth, credentials, serviceTokenEndpoints
+	defer func() { releaseCheckAuth, credentials, serviceTokenEndpoints = savedAuth, savedCredentials, savedEndpoints }()
+	releaseCheckAuth = "type=bearer,token-from=env:RELEASE_CHECK_TOKEN"
+
+	for i := 0; i < 2; i++ {
+		if err := setupHTTPClients(); err != nil {
+			t.Fatal(err)
+		}
+		if len(credentials) != len(flagCredentials)+1 {
+			t.Fatalf("setup %d: %d credentials, want the %d flag credentials and the release-check token", i+1, len(credentials), len(flagCredentials))
+		}
+	}
+	if len(flagCredentials) != 3 {
+		t.Errorf("setup changed the flag credentials to %d", len(flagCredentials))
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		policy  RetryPolicy
+		attempt int
+		want    time.Duration
+	}{
+		{"first attempt", RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}, 0, time.Second},
+		{"doubled", RetryPolicy{BaseDelay: time.Second, MaxDelay: time.Minute}, 3, 8 * time.Second},
+		{"capped", RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}, 5, 10 * time.Second},
+		{"no cap keeps doubling", RetryPolicy{BaseDelay: time.Second}, 5, 32 * time.Second},
+		// doubling stops before it overflows, at the last doubling below math.MaxInt64
+		{"no cap does not overflow", RetryPolicy{BaseDelay: time.Second}, 100, time.Second << 33},
+		{"no base delay", RetryPolicy{MaxDelay: time.Minute}, 3, 0},
+	} {
+		for i := 0; i < 20; i++ {
+			delay := backoffDelay(test.policy, test.attempt)
+			if delay < test.want/2 || delay > test.want {
+				t.Errorf("%s: delay %s, want between %s and %s", test.name, delay, test.want/2, test.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	jetIdKey        = "jetId"
+	projectNameKey  = "projectName"
+	defaultRegistry = "docker.io"
+)
+
+var discoverImages bool
+var imageMappingFile string
+
+// ImageMapping holds the policy identifiers for an image that cannot be read off the image itself.
+type ImageMapping struct {
+	JetId              string `json:"jetId" yaml:"jetId"`
+	SealId             string `json:"sealId" yaml:"sealId"`
+	ProjectName        string `json:"projectName" yaml:"projectName"`
+	ArtifactCreateDate string `json:"artifactCreateDate" yaml:"artifactCreateDate"`
+	RepoUrl            string `json:"repoUrl" yaml:"repoUrl"`
+}
+
+type ImageMappingFile struct {
+	Images map[string]ImageMapping `json:"images" yaml:"images"`
+}
+
+// ImageReference is a parsed container image reference such as registry:5000/org/app:1.2@sha256:...
+type ImageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+func parseImageReference(ref string) (ImageReference, error) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return ImageReference{}, fmt.Errorf("empty image reference")
+	}
+	var image ImageReference
+	if ix := strings.Index(ref, "@"); ix != -1 {
+		image.Digest = ref[ix+1:]
+		ref = ref[:ix]
+		if !strings.Contains(image.Digest, ":") {
+			return ImageReference{}, fmt.Errorf("invalid digest %q", image.Digest)
+		}
+	}
+	// a colon after the last slash separates the tag, a colon before it belongs to the registry port
+	if ix := strings.LastIndex(ref, ":"); ix != -1 && ix > strings.LastIndex(ref, "/") {
+		image.Tag = ref[ix+1:]
+		ref = ref[:ix]
+	}
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		image.Registry, image.Repository = parts[0], parts[1]
+	} else {
+		image.Registry, image.Repository = defaultRegistry, ref
+	}
+	if image.Registry == defaultRegistry && !strings.Contains(image.Repository, "/") {
+		image.Repository = "library/" + image.Repository
+	}
+	if image.Repository == "" {
+		return ImageReference{}, fmt.Errorf("invalid image reference %q", ref)
+	}
+	return image, nil
+}
+
+// Name returns the image without tag or digest, keeping the registry as it would be written by hand.
+func (i ImageReference) Name() string {
+	if i.Registry == defaultRegistry {
+		return strings.TrimPrefix(i.Repository, "library/")
+	}
+	return i.Registry + "/" + i.Repository
+}
+
+// ShortName returns the last path element of the repository, e.g. "api" for "ghcr.io/org/api".
+func (i ImageReference) ShortName() string {
+	return i.Repository[strings.LastIndex(i.Repository, "/")+1:]
+}
+
+func (i ImageReference) String() string {
+	s := i.Name()
+	if i.Tag != "" {
+		s += ":" + i.Tag
+	}
+	if i.Digest != "" {
+		s += "@" + i.Digest
+	}
+	return s
+}
+
+// loadJobPayloads parses the --payload flags and, when --discover-images is set,
+// appends a payload for every image found on the application that was not passed explicitly.
+// When the application can be read every payload is also matched to the source it was deployed from.
+// With --resolve-digests the artifact ids are then resolved through the registry.
+func loadJobPayloads(ctx context.Context, client *KubeClient) ([]JobPayload, error) {
+	jobPayloads, err := readJobPayloads(ctx, client)
+	if err != nil || !resolveDigests {
+		return jobPayloads, err
+	}
+	if err := resolveArtifactDigests(ctx, jobPayloads); err != nil {
+		return nil, err
+	}
+	return jobPayloads, nil
+}
+
+func readJobPayloads(ctx context.Context, client *KubeClient) ([]JobPayload, error) {
+	jobPayloads := make([]JobPayload, 0, len(payloads))
+	for _, payload := range payloads {
+		var jobPayload JobPayload
+		if err := json.Unmarshal([]byte(payload), &jobPayload); err != nil {
+			return nil, fmt.Errorf("error while parsing job payload %v", err)
+		}
+		jobPayloads = append(jobPayloads, jobPayload)
+	}
+
+	if client == nil || strings.TrimSpace(argocdAppName) == "" {
+		for i := range jobPayloads {
+			applyRevisionFlags(&jobPayloads[i])
+		}
+		return jobPayloads, nil
+	}
+
+	app, err := client.GetApplication(ctx, argocdNamespace, argocdAppName)
+	if err != nil {
+		if discoverImages {
+			return nil, fmt.Errorf("error while fetching application %s for image discovery: %v", argocdAppName, err)
+		}
+		log.Printf("WARNING: could not read application %s, using git-branch and git-last-commitId for every image: %v", argocdAppName, err)
+		for i := range jobPayloads {
+			applyRevisionFlags(&jobPayloads[i])
+		}
+		return jobPayloads, nil
+	}
+
+	if discoverImages {
+		discovered, err := discoverJobPayloads(app)
+		if err != nil {
+			return nil, err
+		}
+
+		explicit := make(map[string]bool)
+		for _, jobPayload := range jobPayloads {
+			explicit[jobPayload.ArtifactName] = true
+		}
+		for _, jobPayload := range discovered {
+			if explicit[jobPayload.ArtifactName] {
+				continue
+			}
+			log.Printf("discovered image %s:%s on application %s", jobPayload.ArtifactName, jobPayload.ArtifactTag, argocdAppName)
+			jobPayloads = append(jobPayloads, jobPayload)
+		}
+		if len(jobPayloads) == 0 {
+			return nil, fmt.Errorf("no images found on application %s and no payload flag set", argocdAppName)
+		}
+	}
+
+	mapSourceRevisions(app, jobPayloads)
+	return jobPayloads, nil
+}
+
+// discoverJobPayloads builds a JobPayload for every image in .status.summary.images
+// and every kustomize image override in the application sources.
+func discoverJobPayloads(app *Application) ([]JobPayload, error) {
+	mappings, err := loadImageMappings(imageMappingFile)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := append([]string{}, app.Status.Summary.Images...)
+	for _, source := range app.Spec.AllSources() {
+		if source.Kustomize == nil {
+			continue
+		}
+		for _, override := range source.Kustomize.Images {
+			// kustomize overrides are either "image:tag" or "name=image:tag"
+			if ix := strings.Index(override, "="); ix != -1 {
+				override = override[ix+1:]
+			}
+			refs = append(refs, override)
+		}
+	}
+
+	seen := make(map[string]bool)
+	jobPayloads := make([]JobPayload, 0, len(refs))
+	for _, ref := range refs {
+		image, err := parseImageReference(ref)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing image %q from application %s: %v", ref, app.Metadata.Name, err)
+		}
+		if seen[image.String()] {
+			continue
+		}
+		seen[image.String()] = true
+
+		mapping := mappingForImage(mappings, image)
+		jobPayload := JobPayload{
+			ArtifactName:       image.Name(),
+			ArtifactTag:        image.Tag,
+			ArtifactId:         image.Digest,
+			ArtifactLocation:   image.String(),
+			ArtifactCreateDate: mapping.ArtifactCreateDate,
+			JetId:              firstNonEmpty(mapping.JetId, applicationMetadataValue(app, jetIdKey)),
+			SealId:             firstNonEmpty(mapping.SealId, applicationMetadataValue(app, sealIdLabel)),
+			ProjectName:        firstNonEmpty(mapping.ProjectName, applicationMetadataValue(app, projectNameKey), app.Spec.Project),
+			DeploymentId:       applicationMetadataValue(app, deploymentIdLabel),
+			RepoUrl:            mapping.RepoUrl,
+		}
+		if jobPayload.JetId == "" {
+			return nil, fmt.Errorf("no jetId found for image %s, set it in the image mapping file or as a %s label on application %s", image.Name(), jetIdKey, app.Metadata.Name)
+		}
+		jobPayloads = append(jobPayloads, jobPayload)
+	}
+	return jobPayloads, nil
+}
+
+func loadImageMappings(path string) (map[string]ImageMapping, error) {
+	if strings.TrimSpace(path) == "" {
+		return map[string]ImageMapping{}, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading image mapping file %s: %v", path, err)
+	}
+	// yaml is a superset of json so both formats are accepted here
+	var mappingFile ImageMappingFile
+	if err := yaml.Unmarshal(content, &mappingFile); err != nil {
+		return nil, fmt.Errorf("error parsing image mapping file %s: %v", path, err)
+	}
+	return mappingFile.Images, nil
+}
+
+// mappingForImage looks the image up by its full name first and then by its short name.
+func mappingForImage(mappings map[string]ImageMapping, image ImageReference) ImageMapping {
+	for _, key := range []string{image.Name(), image.Registry + "/" + image.Repository, image.ShortName()} {
+		if mapping, ok := mappings[key]; ok {
+			return mapping
+		}
+	}
+	return ImageMapping{}
+}
+
+// applicationMetadataValue reads key from the application labels, falling back to its annotations.
+func applicationMetadataValue(app *Application, key string) string {
+	if value := strings.TrimSpace(app.Metadata.Labels[key]); value != "" {
+		return value
+	}
+	return strings.TrimSpace(app.Metadata.Annotations[key])
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return value
+		}
+	}
+	return ""
+}
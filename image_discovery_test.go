@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const checkoutDigest = "sha256:4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945"
+
+// shopApplication deploys cart and checkout from two sources with a values-only third source,
+// together with an nginx sidecar and a kustomize override for the cart worker.
+var shopApplication = fmt.Sprintf(`{
+	"apiVersion": "argoproj.io/v1alpha1",
+	"kind": "Application",
+	"metadata": {
+		"name": "shop",
+		"namespace": "argocd",
+		"labels": {"jetId": "jet-7", "sealId": "88000", "deploymentId": "dep-9"},
+		"annotations": {"projectName": "Shop"}
+	},
+	"spec": {
+		"project": "default",
+		"sources": [
+			{"repoURL": "https://git.example.com/team/cart.git", "targetRevision": "release/2.x",
+				"kustomize": {"images": ["registry.example.com/team/cart-worker=registry.example.com/team/cart-worker:2.1.0"]}},
+			{"repoURL": "https://git.example.com/team/checkout", "targetRevision": "main"},
+			{"repoURL": "https://git.example.com/team/values.git", "targetRevision": "main", "ref": "values"}
+		]
+	},
+	"status": {
+		"summary": {"images": ["registry.example.com/team/cart:2.0.1", "registry.example.com/team/checkout@%s", "nginx:1.25", "nginx:1.25"]},
+		"sync": {"revisions": ["1111111", "2222222", "3333333"]}
+	}
+}`, checkoutDigest)
+
+// withDiscoveryFlags discovers the images of application app next to the given --payload flags.
+func withDiscoveryFlags(t *testing.T, app string, payloadFlags ...string) {
+	t.Helper()
+	savedPayloads, savedDiscover, savedMapping, savedResolve := payloads, discoverImages, imageMappingFile, resolveDigests
+	savedApp, savedNamespace := argocdAppName, argocdNamespace
+	t.Cleanup(func() {
+		payloads, discoverImages, imageMappingFile, resolveDigests = savedPayloads, savedDiscover, savedMapping, savedResolve
+		argocdAppName, argocdNamespace = savedApp, savedNamespace
+	})
+	payloads, discoverImages, imageMappingFile, resolveDigests = payloadFlags, true, "", false
+	argocdAppName, argocdNamespace = app, "argocd"
+	withRevisionFlags(t, "flag-branch", "flagcommit")
+}
+
+func newDiscoveryKubeClient(t *testing.T) *KubeClient {
+	t.Helper()
+	var seen []string
+	server := fakeApiServer(t, "Bearer api-token", &seen, shopApplication,
+		`{"metadata": {"name": "unlabeled", "namespace": "argocd"}, "status": {"summary": {"images": ["registry.example.com/team/api:1.0"]}}}`,
+		`{"metadata": {"name": "empty", "namespace": "argocd", "labels": {"jetId": "jet-7"}}}`)
+	return newKubeClientForHost(server.URL, "api-token", server.Client())
+}
+
+func TestLoadJobPayloadsDiscoversImages(t *testing.T) {
+	withDiscoveryFlags(t, "shop", `{"artifactName":"registry.example.com/team/cart","artifactTag":"2.0.1","jetId":"jet-explicit"}`)
+	imageMappingFile = filepath.Join(t.TempDir(), "images.yaml")
+	writeFile(t, imageMappingFile, []byte("images:\n  checkout:\n    jetId: jet-checkout\n    artifactCreateDate: \"2024-05-01T10:00:00Z\"\n"))
+
+	jobPayloads, err := loadJobPayloads(context.Background(), newDiscoveryKubeClient(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []JobPayload{
+		{ArtifactName: "registry.example.com/team/cart", ArtifactTag: "2.0.1", JetId: "jet-explicit",
+			RepoUrl: "https://git.example.com/team/cart.git", Branch: "release/2.x", CommitId: "1111111"},
+		{ArtifactName: "registry.example.com/team/checkout", ArtifactId: checkoutDigest, ArtifactLocation: "registry.example.com/team/checkout@" + checkoutDigest,
+			ArtifactCreateDate: "2024-05-01T10:00:00Z", JetId: "jet-checkout", SealId: "88000", ProjectName: "Shop", DeploymentId: "dep-9",
+			RepoUrl: "https://git.example.com/team/checkout", Branch: "main", CommitId: "2222222"},
+		{ArtifactName: "nginx", ArtifactTag: "1.25", ArtifactLocation: "nginx:1.25", JetId: "jet-7", SealId: "88000", ProjectName: "Shop", DeploymentId: "dep-9",
+			Branch: "flag-branch", CommitId: "flagcommit"},
+		{ArtifactName: "registry.example.com/team/cart-worker", ArtifactTag: "2.1.0", ArtifactLocation: "registry.example.com/team/cart-worker:2.1.0",
+			JetId: "jet-7", SealId: "88000", ProjectName: "Shop", DeploymentId: "dep-9", Branch: "flag-branch", CommitId: "flagcommit"},
+	}
+	if len(jobPayloads) != len(want) {
+		t.Fatalf("got %d payloads, want %d: %+v", len(jobPayloads), len(want), jobPayloads)
+	}
+	for i := range want {
+		if jobPayloads[i] != want[i] {
+			t.Errorf("payload %d\n got %+v\nwant %+v", i, jobPayloads[i], want[i])
+		}
+	}
+}
+
+func TestLoadJobPayloadsWithoutDiscovery(t *testing.T) {
+	withDiscoveryFlags(t, "shop", `{"artifactName":"registry.example.com/team/checkout","artifactTag":"1.0","jetId":"jet-1"}`)
+	discoverImages = false
+
+	jobPayloads, err := loadJobPayloads(context.Background(), newDiscoveryKubeClient(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobPayloads) != 1 || jobPayloads[0].RepoUrl != "https://git.example.com/team/checkout" || jobPayloads[0].Branch != "main" || jobPayloads[0].CommitId != "2222222" {
+		t.Errorf("got %+v, want only the payload flag mapped to the checkout source", jobPayloads)
+	}
+
+	// an application that cannot be read leaves the payloads to the revision flags
+	argocdAppName = "missing"
+	jobPayloads, err = loadJobPayloads(context.Background(), newDiscoveryKubeClient(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobPayloads) != 1 || jobPayloads[0].Branch != "flag-branch" || jobPayloads[0].CommitId != "flagcommit" {
+		t.Errorf("got %+v, want the payload flag with the revision flags", jobPayloads)
+	}
+}
+
+func TestLoadJobPayloadsDiscoveryErrors(t *testing.T) {
+	for _, test := range []struct {
+		app  string
+		want string
+	}{
+		{"missing", "error while fetching application missing for image discovery"},
+		{"unlabeled", "no jetId found for image registry.example.com/team/api"},
+		{"empty", "no images found on application empty"},
+	} {
+		withDiscoveryFlags(t, test.app)
+		if _, err := loadJobPayloads(context.Background(), newDiscoveryKubeClient(t)); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error containing %q", test.app, err, test.want)
+		}
+	}
+}
+
+func TestParseImageReference(t *testing.T) {
+	for _, test := range []struct {
+		ref  string
+		want ImageReference
+		name string
+	}{
+		{"nginx", ImageReference{Registry: defaultRegistry, Repository: "library/nginx"}, "nginx"},
+		{"nginx:1.25", ImageReference{Registry: defaultRegistry, Repository: "library/nginx", Tag: "1.25"}, "nginx"},
+		{"team/app:1.0", ImageReference{Registry: defaultRegistry, Repository: "team/app", Tag: "1.0"}, "team/app"},
+		{"localhost/app", ImageReference{Registry: "localhost", Repository: "app"}, "localhost/app"},
+		{"registry:5000/team/app:1.0@" + checkoutDigest, ImageReference{Registry: "registry:5000", Repository: "team/app", Tag: "1.0", Digest: checkoutDigest}, "registry:5000/team/app"},
+		{"ghcr.io/org/api@" + checkoutDigest, ImageReference{Registry: "ghcr.io", Repository: "org/api", Digest: checkoutDigest}, "ghcr.io/org/api"},
+	} {
+		image, err := parseImageReference(test.ref)
+		if err != nil || image != test.want || image.Name() != test.name {
+			t.Errorf("parseImageReference(%q) = %+v, %v, want %+v named %s", test.ref, image, err, test.want, test.name)
+		}
+	}
+	for _, ref := range []string{"", "app@latest"} {
+		if _, err := parseImageReference(ref); err == nil {
+			t.Errorf("parseImageReference(%q) accepted an invalid reference", ref)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultImagePolicyEnvironment = "*"
+	impliedImageTag               = "latest"
+)
+
+var imagePolicyFile string
+
+// ImagePolicy declares per target environment which image references may be deployed.
+// The "*" environment applies to every environment without its own entry.
+type ImagePolicy struct {
+	Environments map[string]ImageEnvironmentPolicy `json:"environments" yaml:"environments"`
+}
+
+type ImageEnvironmentPolicy struct {
+	// MutableTags are rejected tags such as latest, an image without tag and digest counts as latest.
+	MutableTags []string `json:"mutableTags" yaml:"mutableTags"`
+	// RequireDigest rejects images that are not pinned by digest.
+	RequireDigest bool `json:"requireDigest" yaml:"requireDigest"`
+	// AllowedRegistries lists the registries images may come from, empty allows every registry.
+	AllowedRegistries []string `json:"allowedRegistries" yaml:"allowedRegistries"`
+	// AllowedRepositories lists path patterns matched against registry/repository, for example
+	// docker.io/library/nginx or ghcr.io/org/*. A trailing /** matches every repository below a prefix.
+	// Empty allows every repository.
+	AllowedRepositories []string `json:"allowedRepositories" yaml:"allowedRepositories"`
+}
+
+// loadImagePolicy reads --image-policy-file, returning nil when it is not set.
+func loadImagePolicy(file string) (*ImagePolicy, error) {
+	if strings.TrimSpace(file) == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading image policy file %s: %v", file, err)
+	}
+	var policy ImagePolicy
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("error parsing image policy file %s: %v", file, err)
+	}
+	for environment, environmentPolicy := range policy.Environments {
+		for _, pattern := range environmentPolicy.AllowedRepositories {
+			if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), ""); err != nil {
+				return nil, fmt.Errorf("invalid repository pattern %q for environment %s in image policy file %s: %v", pattern, environment, file, err)
+			}
+		}
+	}
+	return &policy, nil
+}
+
+// forEnvironment returns the policy of environment, falling back to "*".
+func (p *ImagePolicy) forEnvironment(environment string) (ImageEnvironmentPolicy, bool) {
+	for name, environmentPolicy := range p.Environments {
+		if strings.EqualFold(name, strings.TrimSpace(environment)) {
+			return environmentPolicy, true
+		}
+	}
+	environmentPolicy, ok := p.Environments[defaultImagePolicyEnvironment]
+	return environmentPolicy, ok
+}
+
+// payloadImageReference builds the image reference that is deployed from the name and tag of a
+// payload, taking the digest from the name or the artifact location. The artifact id is not used,
+// --resolve-digests fills it for images deployed by tag, so it does not mean the image is pinned.
+func payloadImageReference(payload JobPayload) (ImageReference, error) {
+	ref := payload.ArtifactName
+	if payload.ArtifactTag != "" {
+		ref += ":" + payload.ArtifactTag
+	}
+	image, err := parseImageReference(ref)
+	if err != nil {
+		return ImageReference{}, err
+	}
+	if image.Digest == "" && strings.Contains(payload.ArtifactLocation, "@") {
+		if location, err := parseImageReference(payload.ArtifactLocation); err == nil {
+			image.Digest = location.Digest
+		}
+	}
+	return image, nil
+}
+
+// evaluateImagePolicy returns every rule of policy the image violates.
+func evaluateImagePolicy(policy ImageEnvironmentPolicy, image ImageReference) []string {
+	violations := make([]string, 0)
+	tag := image.Tag
+	if tag == "" && image.Digest == "" {
+		tag = impliedImageTag
+	}
+	if tag != "" && containsFold(policy.MutableTags, tag) {
+		violations = append(violations, fmt.Sprintf("mutable tag %q is not allowed", tag))
+	}
+	if policy.RequireDigest && image.Digest == "" {
+		violations = append(violations, "image has to be pinned by digest")
+	}
+	if len(policy.AllowedRegistries) > 0 && !containsFold(policy.AllowedRegistries, image.Registry) {
+		violations = append(violations, fmt.Sprintf("registry %s is not allowed", image.Registry))
+	}
+	if len(policy.AllowedRepositories) > 0 && !matchesRepository(policy.AllowedRepositories, image) {
+		violations = append(violations, fmt.Sprintf("repository %s/%s is not allowed", image.Registry, image.Repository))
+	}
+	return violations
+}
+
+func matchesRepository(patterns []string, image ImageReference) bool {
+	name := image.Registry + "/" + image.Repository
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+			if strings.HasPrefix(name, prefix+"/") {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// checkImagePolicy evaluates the policy of --target-environment for every payload, one result per image.
+func checkImagePolicy(policy *ImagePolicy, jobPayloads []JobPayload) []CheckResult {
+	results := make([]CheckResult, 0, len(jobPayloads))
+	environmentPolicy, ok := policy.forEnvironment(targetEnvironment)
+	for _, payload := range jobPayloads {
+		started := time.Now()
+		result := CheckResult{Check: imagePolicyCheck, Subject: payloadSubject(payload)}
+		if !ok {
+			result.Outcome = outcomeSkipped
+			result.Message = fmt.Sprintf("no image policy for environment %q", targetEnvironment)
+			results = append(results, result)
+			continue
+		}
+		image, err := payloadImageReference(payload)
+		if err != nil {
+			result.Outcome = outcomeError
+			result.Message = fmt.Sprintf("error parsing image reference: %v", err)
+		} else if violations := evaluateImagePolicy(environmentPolicy, image); len(violations) > 0 {
+			result.Outcome = outcomeFail
+			result.Message = strings.Join(violations, "; ")
+			log.Printf("FAILURE: Image policy failed for Image: %s - %s", image, result.Message)
+		} else {
+			result.Outcome = outcomePass
+			result.Message = fmt.Sprintf("%s allowed in %s", image, firstNonEmpty(targetEnvironment, defaultImagePolicyEnvironment))
+			log.Printf("SUCCESS: Image policy passed for Image: %s", image)
+		}
+		result.Duration = time.Since(started)
+		results = append(results, result)
+	}
+	return results
+}
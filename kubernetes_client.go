@@ -1,67 +1,605 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os/exec"
-	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	applicationsApiPath   = "/apis/argoproj.io/v1alpha1/namespaces/%s/applications/%s"
+	configMapsApiPath     = "/api/v1/namespaces/%s/configmaps"
+	eventsApiPath         = "/api/v1/namespaces/%s/events"
+	secretsApiPath        = "/api/v1/namespaces/%s/secrets/%s"
+	mergePatchContentType = "application/merge-patch+json"
+	kubeApiRequestTimeout = 30
+	sealIdLabel           = "sealId"
+	deploymentIdLabel     = "deploymentId"
 )
 
-func getDeploymentIdAndSealId() error {
-	app := "kubectl"
-	//kubectl get app <appname> -o jsonpath='{.metadata.labels}'
-	arg0 := "get"
-	arg1 := "app"
-	arg2 := argocdAppName
-	arg3 := "-o" 
-	arg4 := "jsonpath='{.metadata.labels}'"
-	arg6 := "-n"
-	arg7 := argocdNamespace
-	cmd := exec.Command(app, arg0,arg1,arg2,arg3,arg4, arg6, arg7)
-// 	var out bytes.Buffer
-var stderr bytes.Buffer
-// cmd.Stdout = &out
-cmd.Stderr = &stderr
-	// err := cmd.Run()
-	// // labelsJson, err := cmd.Output()
-	// labelsJson := out.String()
-	labelsJson, err := cmd.Output()
-	labelsJson = labelsJson[1:len(labelsJson)-1]
+var kubeconfigPath string
+
+// serviceAccountDir is where the in-cluster token and ca certificate are mounted.
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+var (
+	// ErrNotFound is returned when the requested object does not exist in the cluster.
+	ErrNotFound = errors.New("not found")
+	// ErrForbidden is returned when the service account is not allowed to access the object.
+	ErrForbidden = errors.New("forbidden")
+	// ErrUnauthorized is returned when the cluster rejects the credentials.
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrConflict is returned when the object already exists or was changed concurrently.
+	ErrConflict = errors.New("conflict")
+)
+
+// KubeAPIError is returned for every non 2xx response from the kubernetes api server.
+type KubeAPIError struct {
+	StatusCode int
+	Reason     string
+	Message    string
+	Path       string
+}
+
+func (e *KubeAPIError) Error() string {
+	return fmt.Sprintf("kubernetes api %s returned %d %s: %s", e.Path, e.StatusCode, e.Reason, e.Message)
+}
+
+func (e *KubeAPIError) Unwrap() error {
+	switch e.StatusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusConflict:
+		return ErrConflict
+	}
+	return nil
+}
+
+// MissingLabelError is returned when a label expected on the application is not set.
+type MissingLabelError struct {
+	Application string
+	Label       string
+}
+
+func (e *MissingLabelError) Error() string {
+	return fmt.Sprintf("label %q is not set on application %s", e.Label, e.Application)
+}
+
+type ObjectMeta struct {
+	Name            string            `json:"name,omitempty"`
+	GenerateName    string            `json:"generateName,omitempty"`
+	Namespace       string            `json:"namespace"`
+	UID             string            `json:"uid,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+type Application struct {
+	ApiVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Spec       ApplicationSpec   `json:"spec"`
+	Status     ApplicationStatus `json:"status"`
+}
+
+type ApplicationSpec struct {
+	Project string              `json:"project"`
+	Source  *ApplicationSource  `json:"source,omitempty"`
+	Sources []ApplicationSource `json:"sources,omitempty"`
+}
+
+type ApplicationSource struct {
+	RepoURL        string                      `json:"repoURL"`
+	Path           string                      `json:"path,omitempty"`
+	TargetRevision string                      `json:"targetRevision,omitempty"`
+	Chart          string                      `json:"chart,omitempty"`
+	Ref            string                      `json:"ref,omitempty"`
+	Kustomize      *ApplicationSourceKustomize `json:"kustomize,omitempty"`
+}
+
+type ApplicationSourceKustomize struct {
+	Images []string `json:"images,omitempty"`
+}
+
+type ApplicationStatus struct {
+	Summary        ApplicationSummary `json:"summary"`
+	Sync           SyncStatus         `json:"sync"`
+	OperationState *OperationState    `json:"operationState,omitempty"`
+}
+
+type OperationState struct {
+	Phase      string               `json:"phase"`
+	Message    string               `json:"message,omitempty"`
+	StartedAt  string               `json:"startedAt,omitempty"`
+	FinishedAt string               `json:"finishedAt,omitempty"`
+	SyncResult *SyncOperationResult `json:"syncResult,omitempty"`
+}
+
+type SyncOperationResult struct {
+	Revision  string               `json:"revision,omitempty"`
+	Revisions []string             `json:"revisions,omitempty"`
+	Resources []ResourceSyncResult `json:"resources,omitempty"`
+}
+
+type ResourceSyncResult struct {
+	Group     string `json:"group,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Status    string `json:"status,omitempty"`
+	Message   string `json:"message,omitempty"`
+	HookType  string `json:"hookType,omitempty"`
+	HookPhase string `json:"hookPhase,omitempty"`
+	SyncPhase string `json:"syncPhase,omitempty"`
+}
+
+type ApplicationSummary struct {
+	Images []string `json:"images,omitempty"`
+}
+
+type SyncStatus struct {
+	Status    string   `json:"status"`
+	Revision  string   `json:"revision,omitempty"`
+	Revisions []string `json:"revisions,omitempty"`
+}
+
+// AllSources returns the sources of a multi-source application, or the single source wrapped in a slice.
+func (s ApplicationSpec) AllSources() []ApplicationSource {
+	if len(s.Sources) > 0 {
+		return s.Sources
+	}
+	if s.Source != nil {
+		return []ApplicationSource{*s.Source}
+	}
+	return nil
+}
+
+type ConfigMap struct {
+	ApiVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   ObjectMeta        `json:"metadata"`
+	Data       map[string]string `json:"data,omitempty"`
+}
+
+// Secret is a core v1 Secret, Data holds base64 encoded values.
+type Secret struct {
+	Metadata ObjectMeta        `json:"metadata"`
+	Data     map[string]string `json:"data,omitempty"`
+}
+
+// Event is a core v1 Event, reported against InvolvedObject.
+type Event struct {
+	ApiVersion         string          `json:"apiVersion"`
+	Kind               string          `json:"kind"`
+	Metadata           ObjectMeta      `json:"metadata"`
+	InvolvedObject     ObjectReference `json:"involvedObject"`
+	Reason             string          `json:"reason"`
+	Message            string          `json:"message"`
+	Type               string          `json:"type"`
+	Source             EventSource     `json:"source"`
+	ReportingComponent string          `json:"reportingComponent,omitempty"`
+	ReportingInstance  string          `json:"reportingInstance,omitempty"`
+	FirstTimestamp     string          `json:"firstTimestamp"`
+	LastTimestamp      string          `json:"lastTimestamp"`
+	Count              int             `json:"count"`
+}
+
+type ObjectReference struct {
+	ApiVersion      string `json:"apiVersion"`
+	Kind            string `json:"kind"`
+	Namespace       string `json:"namespace"`
+	Name            string `json:"name"`
+	UID             string `json:"uid,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type EventSource struct {
+	Component string `json:"component"`
+	Host      string `json:"host,omitempty"`
+}
+
+// KubeClient is a minimal client for the kubernetes api server. It only implements
+// the handful of calls the policy job needs so that the image does not have to ship kubectl.
+type KubeClient struct {
+	host       string
+	token      string
+	tokenFile  string
+	username   string
+	password   string
+	httpClient *http.Client
+}
+
+// NewKubeClient builds a client from the in-cluster service account when running inside a pod,
+// otherwise from the kubeconfig given by --kubeconfig, $KUBECONFIG or ~/.kube/config.
+func NewKubeClient() (*KubeClient, error) {
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" && strings.TrimSpace(kubeconfigPath) == "" {
+		return newInClusterKubeClient()
+	}
+	path := kubeconfigPath
+	if strings.TrimSpace(path) == "" {
+		path = os.Getenv("KUBECONFIG")
+	}
+	if strings.TrimSpace(path) == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("not running in a cluster and no kubeconfig found: %v", err)
+		}
+		path = filepath.Join(home, ".kube", "config")
+	}
+	return newKubeconfigKubeClient(path)
+}
+
+// newKubeClientForHost returns a client talking to host with an optional bearer token, such as a
+// fake api server in the tests.
+func newKubeClientForHost(host, token string, httpClient *http.Client) *KubeClient {
+	return &KubeClient{
+		host:       strings.TrimSuffix(host, "/"),
+		token:      token,
+		httpClient: httpClient,
+	}
+}
+
+func newInClusterKubeClient() (*KubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set for in-cluster config")
+	}
+	tokenFile := filepath.Join(serviceAccountDir, "token")
+	if _, err := os.Stat(tokenFile); err != nil {
+		return nil, fmt.Errorf("service account token is not mounted: %v", err)
+	}
+	caData, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
 	if err != nil {
-		return fmt.Errorf("command %s failed with output: %s and error: %v", app, &stderr, err)
+		return nil, fmt.Errorf("error reading service account ca certificate: %v", err)
 	}
-	var labels map[string]string
-	if err := json.Unmarshal(labelsJson, &labels); err != nil {
-		return fmt.Errorf("error parsing application labels json: %s failed with error: %v", labelsJson, err)
+	tlsConfig, err := kubeTLSConfig(caData, false, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &KubeClient{
+		host:       "https://" + net.JoinHostPort(host, port),
+		tokenFile:  tokenFile,
+		httpClient: kubeHTTPClient(tlsConfig),
+	}, nil
+}
+
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string    `yaml:"token"`
+			TokenFile             string    `yaml:"tokenFile"`
+			Username              string    `yaml:"username"`
+			Password              string    `yaml:"password"`
+			ClientCertificate     string    `yaml:"client-certificate"`
+			ClientCertificateData string    `yaml:"client-certificate-data"`
+			ClientKey             string    `yaml:"client-key"`
+			ClientKeyData         string    `yaml:"client-key-data"`
+			Exec                  yaml.Node `yaml:"exec"`
+			AuthProvider          yaml.Node `yaml:"auth-provider"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+func newKubeconfigKubeClient(path string) (*KubeClient, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading kubeconfig %s: %v", path, err)
+	}
+	var config kubeconfig
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("error parsing kubeconfig %s: %v", path, err)
+	}
+	baseDir := filepath.Dir(path)
+
+	var clusterName, userName string
+	for _, c := range config.Contexts {
+		if c.Name == config.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("current-context %q not found in kubeconfig %s", config.CurrentContext, path)
+	}
+
+	client := &KubeClient{}
+	var caData []byte
+	insecure := false
+	found := false
+	for _, c := range config.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		found = true
+		client.host = strings.TrimSuffix(c.Cluster.Server, "/")
+		insecure = c.Cluster.InsecureSkipTLSVerify
+		if caData, err = dataOrFile(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority, baseDir); err != nil {
+			return nil, fmt.Errorf("error reading certificate authority for cluster %s: %v", clusterName, err)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("cluster %q not found in kubeconfig %s", clusterName, path)
+	}
+
+	var certData, keyData []byte
+	for _, u := range config.Users {
+		if u.Name != userName {
+			continue
+		}
+		if !u.User.Exec.IsZero() || !u.User.AuthProvider.IsZero() {
+			return nil, fmt.Errorf("user %s in kubeconfig %s uses an exec or auth-provider plugin which is not supported, use a token or client certificate", userName, path)
+		}
+		client.token = u.User.Token
+		if u.User.TokenFile != "" {
+			client.tokenFile = resolvePath(u.User.TokenFile, baseDir)
+		}
+		client.username, client.password = u.User.Username, u.User.Password
+		if certData, err = dataOrFile(u.User.ClientCertificateData, u.User.ClientCertificate, baseDir); err != nil {
+			return nil, fmt.Errorf("error reading client certificate for user %s: %v", userName, err)
+		}
+		if keyData, err = dataOrFile(u.User.ClientKeyData, u.User.ClientKey, baseDir); err != nil {
+			return nil, fmt.Errorf("error reading client key for user %s: %v", userName, err)
+		}
+	}
+
+	tlsConfig, err := kubeTLSConfig(caData, insecure, certData, keyData)
+	if err != nil {
+		return nil, err
+	}
+	client.httpClient = kubeHTTPClient(tlsConfig)
+	return client, nil
+}
+
+func dataOrFile(data, file, baseDir string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return os.ReadFile(resolvePath(file, baseDir))
+	}
+	return nil, nil
+}
+
+func resolvePath(path, baseDir string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
+func kubeTLSConfig(caData []byte, insecure bool, certData, keyData []byte) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecure,
+	}
+	if len(caData) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no valid certificates found in the kubernetes certificate authority")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(certData) > 0 || len(keyData) > 0 {
+		cert, err := tls.X509KeyPair(certData, keyData)
+		if err != nil {
+			return nil, fmt.Errorf("error loading kubernetes client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func kubeHTTPClient(tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Timeout:   kubeApiRequestTimeout * time.Second,
+		Transport: transport,
+	}
+}
+
+func (k *KubeClient) bearerToken() (string, error) {
+	if k.tokenFile != "" {
+		// the projected service account token is rotated by the kubelet, so always read it fresh
+		token, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading token file %s: %v", k.tokenFile, err)
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+	return k.token, nil
+}
+
+// do sends a request to the api server and decodes a successful json response into out.
+func (k *KubeClient) do(ctx context.Context, method, path, contentType string, body io.Reader, out interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, method, k.host+path, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	token, err := k.bearerToken()
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	} else if k.username != "" {
+		request.SetBasicAuth(k.username, k.password)
+	}
+
+	resp, err := k.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &KubeAPIError{StatusCode: resp.StatusCode, Path: path, Reason: http.StatusText(resp.StatusCode)}
+		var status struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(content, &status) == nil && status.Message != "" {
+			apiErr.Reason, apiErr.Message = status.Reason, status.Message
+		} else {
+			apiErr.Message = strings.TrimSpace(string(content))
+		}
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(content, out); err != nil {
+		return fmt.Errorf("error parsing response from %s: %v", path, err)
 	}
-	sealId = labels["sealId"]
-	deploymentId = labels["deploymentId"]
 	return nil
 }
 
-// func getImageNameToBranchMapping() (map[string]string, error) {
-// 	cmd := "kubectl"
-// 	//kubectl get app <appname> -o jsonpath='{.metadata.labels}'
-// 	arg0 := "get app"
-// 	arg1 := argocdAppName
-// 	arg2 := "-o jsonpath"
-// 	arg3 := "'{.spec.sources}'"
-// 	sourcesJson, err := exec.Command(cmd, arg0,arg1,arg2,arg3).Output()
-// 	if err != nil {
-// 		return map[string]string{}, err;
-// 	}
-// 	var sources []map[string]string
-// 	if err := json.Unmarshal(sourcesJson, &sources); err != nil {
-// 		return map[string]string{}, err;
-// 	}
-// 	var results map[string]string
-// 	for source := range sources {
-// 		imageName := extractImageNamefromRepoUrl(source["repoURL"])
-// 		results[imageName] = source["targetRevision"]
-// 	}
-// 	return results, nil
-// }
-
-// func extractImageNamefromRepoUrl() string {
-
-// }
\ No newline at end of file
+// GetApplication fetches the argoproj.io Application name from namespace.
+func (k *KubeClient) GetApplication(ctx context.Context, namespace, name string) (*Application, error) {
+	var app Application
+	path := fmt.Sprintf(applicationsApiPath, url.PathEscape(namespace), url.PathEscape(name))
+	if err := k.do(ctx, http.MethodGet, path, "", nil, &app); err != nil {
+		return nil, err
+	}
+	return &app, nil
+}
+
+// PatchApplicationAnnotations sets the given annotations of the Application with a merge patch,
+// a nil value removes the annotation.
+func (k *KubeClient) PatchApplicationAnnotations(ctx context.Context, namespace, name string, annotations map[string]*string) error {
+	patch, err := json.Marshal(map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotations}})
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf(applicationsApiPath, url.PathEscape(namespace), url.PathEscape(name))
+	return k.do(ctx, http.MethodPatch, path, mergePatchContentType, bytes.NewReader(patch), nil)
+}
+
+// CreateEvent records event in namespace.
+func (k *KubeClient) CreateEvent(ctx context.Context, namespace string, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return k.do(ctx, http.MethodPost, fmt.Sprintf(eventsApiPath, url.PathEscape(namespace)), "application/json", bytes.NewReader(body), nil)
+}
+
+// GetSecret fetches the Secret name from namespace.
+func (k *KubeClient) GetSecret(ctx context.Context, namespace, name string) (*Secret, error) {
+	var secret Secret
+	path := fmt.Sprintf(secretsApiPath, url.PathEscape(namespace), url.PathEscape(name))
+	if err := k.do(ctx, http.MethodGet, path, "", nil, &secret); err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+// GetConfigMap fetches the ConfigMap name from namespace.
+func (k *KubeClient) GetConfigMap(ctx context.Context, namespace, name string) (*ConfigMap, error) {
+	var configMap ConfigMap
+	path := fmt.Sprintf(configMapsApiPath, url.PathEscape(namespace)) + "/" + url.PathEscape(name)
+	if err := k.do(ctx, http.MethodGet, path, "", nil, &configMap); err != nil {
+		return nil, err
+	}
+	return &configMap, nil
+}
+
+// PatchConfigMapData sets the given keys of the ConfigMap with a merge patch, a nil value removes the key.
+// The ConfigMap is created when it does not exist yet.
+func (k *KubeClient) PatchConfigMapData(ctx context.Context, namespace, name string, data map[string]*string) error {
+	patch, err := json.Marshal(map[string]interface{}{"data": data})
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf(configMapsApiPath, url.PathEscape(namespace)) + "/" + url.PathEscape(name)
+	err = k.do(ctx, http.MethodPatch, path, mergePatchContentType, bytes.NewReader(patch), nil)
+	if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	configMap := ConfigMap{
+		ApiVersion: "v1",
+		Kind:       "ConfigMap",
+		Metadata:   ObjectMeta{Name: name, Namespace: namespace},
+		Data:       make(map[string]string),
+	}
+	for key, value := range data {
+		if value != nil {
+			configMap.Data[key] = *value
+		}
+	}
+	body, err := json.Marshal(configMap)
+	if err != nil {
+		return err
+	}
+	err = k.do(ctx, http.MethodPost, fmt.Sprintf(configMapsApiPath, url.PathEscape(namespace)), "application/json", bytes.NewReader(body), nil)
+	if errors.Is(err, ErrConflict) {
+		// created by a concurrent writer in the meantime, so the patch applies now
+		return k.do(ctx, http.MethodPatch, path, mergePatchContentType, bytes.NewReader(patch), nil)
+	}
+	return err
+}
+
+func getDeploymentIdAndSealId(ctx context.Context, client *KubeClient) error {
+	app, err := client.GetApplication(ctx, argocdNamespace, argocdAppName)
+	if err != nil {
+		return err
+	}
+	labels := app.Metadata.Labels
+	if strings.TrimSpace(labels[sealIdLabel]) == "" {
+		return &MissingLabelError{Application: argocdAppName, Label: sealIdLabel}
+	}
+	if strings.TrimSpace(labels[deploymentIdLabel]) == "" {
+		return &MissingLabelError{Application: argocdAppName, Label: deploymentIdLabel}
+	}
+	sealId = labels[sealIdLabel]
+	deploymentId = labels[deploymentIdLabel]
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testApplication = `{
+	"apiVersion": "argoproj.io/v1alpha1",
+	"kind": "Application",
+	"metadata": {"name": "payments", "namespace": "argocd", "labels": {"sealId": "88000", "deploymentId": "dep-7"}},
+	"spec": {"project": "default", "source": {"repoURL": "https://git.example.com/payments.git", "targetRevision": "main"}}
+}`
+
+// fakeApiServer serves the payments application in the argocd namespace to requests carrying
+// Authorization header want, records the headers it saw and answers everything else with a Status.
+// ConfigMaps of the argocd namespace can be created, merge patched and read back, and applications
+// passed as json are served under their name next to payments.
+func fakeApiServer(t *testing.T, want string, seen *[]string, applications ...string) *httptest.Server {
+	t.Helper()
+	served := map[string]string{fmt.Sprintf(applicationsApiPath, "argocd", "payments"): testApplication}
+	for _, application := range applications {
+		var app Application
+		if err := json.Unmarshal([]byte(application), &app); err != nil {
+			t.Fatalf("invalid application: %v", err)
+		}
+		served[fmt.Sprintf(applicationsApiPath, "argocd", app.Metadata.Name)] = application
+	}
+	var mu sync.Mutex
+	configMaps := make(map[string]map[string]string)
+	configMapsPath := fmt.Sprintf(configMapsApiPath, "argocd")
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		*seen = append(*seen, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json")
+		name := strings.TrimPrefix(r.URL.Path, configMapsPath+"/")
+		switch {
+		case r.Header.Get("Authorization") != want:
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"kind":"Status","reason":"Unauthorized","message":"Unauthorized"}`)
+		case served[r.URL.Path] != "":
+			fmt.Fprint(w, served[r.URL.Path])
+		case r.URL.Path == configMapsPath && r.Method == http.MethodPost:
+			var configMap ConfigMap
+			if err := json.NewDecoder(r.Body).Decode(&configMap); err != nil {
+				t.Errorf("invalid configmap: %v", err)
+			}
+			if _, ok := configMaps[configMap.Metadata.Name]; ok {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprint(w, `{"kind":"Status","reason":"AlreadyExists","message":"already exists"}`)
+				return
+			}
+			if configMap.Data == nil {
+				configMap.Data = make(map[string]string)
+			}
+			configMaps[configMap.Metadata.Name] = configMap.Data
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(configMap)
+		case strings.HasPrefix(r.URL.Path, configMapsPath+"/") && configMaps[name] != nil && r.Method == http.MethodPatch:
+			if r.Header.Get("Content-Type") != mergePatchContentType {
+				t.Errorf("configmap patched with content type %q", r.Header.Get("Content-Type"))
+			}
+			var patch struct {
+				Data map[string]*string `json:"data"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				t.Errorf("invalid configmap patch: %v", err)
+			}
+			for key, value := range patch.Data {
+				if value == nil {
+					delete(configMaps[name], key)
+				} else {
+					configMaps[name][key] = *value
+				}
+			}
+			json.NewEncoder(w).Encode(ConfigMap{Metadata: ObjectMeta{Name: name}, Data: configMaps[name]})
+		case strings.HasPrefix(r.URL.Path, configMapsPath+"/") && configMaps[name] != nil && r.Method == http.MethodGet:
+			json.NewEncoder(w).Encode(ConfigMap{Metadata: ObjectMeta{Name: name}, Data: configMaps[name]})
+		case r.URL.Path == fmt.Sprintf(applicationsApiPath, "argocd", "forbidden"):
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"kind":"Status","reason":"Forbidden","message":"applications.argoproj.io \"forbidden\" is forbidden"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"kind":"Status","reason":"NotFound","message":"not found"}`)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func serverCA(server *httptest.Server) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+}
+
+func TestGetApplication(t *testing.T) {
+	var seen []string
+	server := fakeApiServer(t, "Bearer api-token", &seen)
+	client := newKubeClientForHost(server.URL+"/", "api-token", server.Client())
+
+	app, err := client.GetApplication(context.Background(), "argocd", "payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Metadata.Labels[sealIdLabel] != "88000" || app.Spec.Source == nil || app.Spec.Source.TargetRevision != "main" {
+		t.Errorf("unexpected application %+v", app)
+	}
+
+	for name, want := range map[string]error{"missing": ErrNotFound, "forbidden": ErrForbidden} {
+		_, err := client.GetApplication(context.Background(), "argocd", name)
+		var apiErr *KubeAPIError
+		if !errors.Is(err, want) || !errors.As(err, &apiErr) || apiErr.Message == "" {
+			t.Errorf("GetApplication(%s) = %v, want %v with the status message", name, err, want)
+		}
+	}
+}
+
+func TestGetDeploymentIdAndSealId(t *testing.T) {
+	var seen []string
+	server := fakeApiServer(t, "", &seen)
+	savedApp, savedNamespace, savedSealId, savedDeploymentId := argocdAppName, argocdNamespace, sealId, deploymentId
+	defer func() {
+		argocdAppName, argocdNamespace, sealId, deploymentId = savedApp, savedNamespace, savedSealId, savedDeploymentId
+	}()
+	argocdAppName, argocdNamespace = "payments", "argocd"
+
+	if err := getDeploymentIdAndSealId(context.Background(), newKubeClientForHost(server.URL, "", server.Client())); err != nil {
+		t.Fatal(err)
+	}
+	if sealId != "88000" || deploymentId != "dep-7" {
+		t.Errorf("got sealId %q and deploymentId %q", sealId, deploymentId)
+	}
+}
+
+func TestInClusterKubeClient(t *testing.T) {
+	var seen []string
+	server := fakeApiServer(t, "Bearer rotated-token", &seen)
+	serverUrl, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := net.SplitHostPort(serverUrl.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	saved := serviceAccountDir
+	defer func() { serviceAccountDir = saved }()
+	serviceAccountDir = dir
+	writeFile(t, filepath.Join(dir, "ca.crt"), serverCA(server))
+	writeFile(t, filepath.Join(dir, "token"), []byte("first-token\n"))
+	t.Setenv("KUBERNETES_SERVICE_HOST", host)
+	t.Setenv("KUBERNETES_SERVICE_PORT", port)
+	savedPath := kubeconfigPath
+	defer func() { kubeconfigPath = savedPath }()
+	kubeconfigPath = ""
+
+	client, err := NewKubeClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetApplication(context.Background(), "argocd", "payments"); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("expected the first token to be rejected, got %v", err)
+	}
+	// the kubelet rotates the projected token, the next request has to pick it up
+	writeFile(t, filepath.Join(dir, "token"), []byte("rotated-token\n"))
+	if _, err := client.GetApplication(context.Background(), "argocd", "payments"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(seen, ",") != "Bearer first-token,Bearer rotated-token" {
+		t.Errorf("sent authorization %v", seen)
+	}
+}
+
+func TestInClusterKubeClientWithoutToken(t *testing.T) {
+	saved := serviceAccountDir
+	defer func() { serviceAccountDir = saved }()
+	serviceAccountDir = t.TempDir()
+	t.Setenv("KUBERNETES_SERVICE_HOST", "10.0.0.1")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "443")
+
+	if _, err := newInClusterKubeClient(); err == nil {
+		t.Fatal("expected an error without a mounted token")
+	}
+}
+
+func TestKubeconfigKubeClient(t *testing.T) {
+	var seen []string
+	server := fakeApiServer(t, "Bearer file-token", &seen)
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "token"), []byte("file-token"))
+	writeFile(t, filepath.Join(dir, "config"), []byte(fmt.Sprintf(`apiVersion: v1
+kind: Config
+current-context: test
+clusters:
+- name: other
+  cluster:
+    server: https://other.example.com
+- name: fake
+  cluster:
+    server: %s/
+    certificate-authority-data: %s
+contexts:
+- name: other
+  context: {cluster: other, user: other}
+- name: test
+  context: {cluster: fake, user: tester}
+users:
+- name: other
+  user: {token: other-token}
+- name: tester
+  user: {tokenFile: token}
+`, server.URL, base64.StdEncoding.EncodeToString(serverCA(server)))))
+
+	client, err := newKubeconfigKubeClient(filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetApplication(context.Background(), "argocd", "payments"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKubeconfigKubeClientErrors(t *testing.T) {
+	for name, config := range map[string]string{
+		"missing context": "current-context: absent\n",
+		"missing cluster": "current-context: test\ncontexts:\n- name: test\n  context: {cluster: absent, user: tester}\n",
+		"exec plugin": `current-context: test
+clusters:
+- name: fake
+  cluster: {server: https://127.0.0.1:6443}
+contexts:
+- name: test
+  context: {cluster: fake, user: tester}
+users:
+- name: tester
+  user:
+    exec: {command: aws}
+`,
+	} {
+		path := filepath.Join(t.TempDir(), "config")
+		writeFile(t, path, []byte(config))
+		if _, err := newKubeconfigKubeClient(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func writeFile(t *testing.T, path string, content []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/open-policy-agent/opa/rego"
+)
+
+var policyPaths []string
+var policyPackage string
+
+// LocalPolicy evaluates Rego policies loaded from --policy next to the remote checks. A policy
+// denies the deployment with a deny rule and warns with a warn rule in the --policy-package package,
+// each producing a message string or an object with msg and an optional subject.
+type LocalPolicy struct {
+	query rego.PreparedEvalQuery
+}
+
+// PolicyInput is the input document of the local policies.
+type PolicyInput struct {
+	Mode              string             `json:"mode"`
+	TargetEnvironment string             `json:"targetEnvironment"`
+	Payloads          []JobPayload       `json:"payloads"`
+	Application       *Application       `json:"application,omitempty"`
+	Git               PolicyGitInput     `json:"git"`
+	ChangeTickets     []string           `json:"changeTickets"`
+	Release           []PolicyCheckInput `json:"release"`
+	ServiceNow        []PolicyCheckInput `json:"servicenow"`
+}
+
+type PolicyGitInput struct {
+	RepoUrl       string `json:"repoUrl"`
+	Branch        string `json:"branch"`
+	CommitId      string `json:"commitId"`
+	CommitMessage string `json:"commitMessage"`
+}
+
+// PolicyCheckInput is the result of a remote check, with its response parsed when it is json.
+type PolicyCheckInput struct {
+	Subject  string      `json:"subject"`
+	Outcome  string      `json:"outcome"`
+	Message  string      `json:"message"`
+	Response interface{} `json:"response,omitempty"`
+}
+
+// loadLocalPolicy compiles the policies given by --policy, or returns nil when none are set.
+// Each path is a .rego or data file, a directory of them, or a bundle .tar.gz.
+func loadLocalPolicy(ctx context.Context) (*LocalPolicy, error) {
+	if len(policyPaths) == 0 {
+		return nil, nil
+	}
+	pkg := strings.TrimPrefix(strings.TrimSpace(policyPackage), "data.")
+	if pkg == "" {
+		return nil, fmt.Errorf("policy-package flag has to be set to evaluate local policies")
+	}
+
+	options := []func(*rego.Rego){
+		rego.Query(fmt.Sprintf("deny := [m | m := data.%[1]s.deny[_]]; warn := [m | m := data.%[1]s.warn[_]]", pkg)),
+	}
+	var files []string
+	for _, path := range policyPaths {
+		if strings.HasSuffix(path, ".tar.gz") || strings.HasSuffix(path, ".tgz") {
+			options = append(options, rego.LoadBundle(path))
+		} else {
+			files = append(files, path)
+		}
+	}
+	if len(files) > 0 {
+		options = append(options, rego.Load(files, nil))
+	}
+
+	query, err := rego.New(options...).PrepareForEval(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error loading policies %s: %v", strings.Join(policyPaths, ", "), err)
+	}
+	return &LocalPolicy{query: query}, nil
+}
+
+// newPolicyInput builds the input document from the payloads, the application and the results of
+// the remote checks collected so far.
+func newPolicyInput(mode string, jobPayloads []JobPayload, app *Application, snowIds []string) PolicyInput {
+	input := PolicyInput{
+		Mode:              mode,
+		TargetEnvironment: targetEnvironment,
+		Payloads:          jobPayloads,
+		Application:       app,
+		Git: PolicyGitInput{
+			RepoUrl:       repoUrl,
+			Branch:        gitBranch,
+			CommitId:      gitLastCommitId,
+			CommitMessage: gitCommitMessage,
+		},
+		ChangeTickets: append([]string{}, snowIds...),
+		Release:       make([]PolicyCheckInput, 0),
+		ServiceNow:    make([]PolicyCheckInput, 0),
+	}
+	for _, result := range runReport.Results() {
+		check := PolicyCheckInput{Subject: result.Subject, Outcome: result.Outcome, Message: result.Message}
+		if result.Response != "" {
+			var response interface{}
+			if err := json.Unmarshal([]byte(result.Response), &response); err == nil {
+				check.Response = response
+			} else {
+				check.Response = result.Response
+			}
+		}
+		switch result.Check {
+		case releaseCheck:
+			input.Release = append(input.Release, check)
+		case serviceNowCheck:
+			input.ServiceNow = append(input.ServiceNow, check)
+		}
+	}
+	return input
+}
+
+// Evaluate runs the policies against input and returns one fail result per deny, one warn result
+// per warn, and a single pass result when neither matched.
+func (p *LocalPolicy) Evaluate(ctx context.Context, input PolicyInput) []CheckResult {
+	started := time.Now()
+	failed := func(err error) []CheckResult {
+		log.Printf("ERROR: While evaluating local policies: %v", err)
+		return []CheckResult{{Check: localPolicyCheck, Subject: strings.Join(policyPaths, ","), Outcome: outcomeError, Message: err.Error(), Duration: time.Since(started)}}
+	}
+
+	// round trip through json so the policies see the same field names as the json input
+	content, err := json.Marshal(input)
+	if err != nil {
+		return failed(err)
+	}
+	var document interface{}
+	if err := json.Unmarshal(content, &document); err != nil {
+		return failed(err)
+	}
+
+	resultSet, err := p.query.Eval(ctx, rego.EvalInput(document))
+	if err != nil {
+		return failed(err)
+	}
+	if len(resultSet) == 0 {
+		return failed(fmt.Errorf("policy query returned no result"))
+	}
+
+	results := make([]CheckResult, 0)
+	for _, binding := range []struct {
+		name    string
+		outcome string
+	}{{"deny", outcomeFail}, {"warn", outcomeWarn}} {
+		messages, _ := resultSet[0].Bindings[binding.name].([]interface{})
+		for _, message := range messages {
+			subject, text := policyMessage(message)
+			if binding.outcome == outcomeFail {
+				log.Printf("FAILURE: Local policy denied %s - %s", subject, text)
+			} else {
+				log.Printf("WARNING: Local policy warned for %s - %s", subject, text)
+			}
+			results = append(results, CheckResult{Check: localPolicyCheck, Subject: subject, Outcome: binding.outcome, Message: text, Duration: time.Since(started)})
+		}
+	}
+	if len(results) == 0 {
+		log.Printf("SUCCESS: Local policies passed")
+		results = append(results, CheckResult{Check: localPolicyCheck, Subject: strings.Join(policyPaths, ","), Outcome: outcomePass, Message: "no deny or warn rule matched", Duration: time.Since(started)})
+	}
+	return results
+}
+
+// policyMessage reads a deny or warn value, either a message or an object with msg and subject.
+func policyMessage(value interface{}) (string, string) {
+	subject := policyPackage
+	switch v := value.(type) {
+	case string:
+		return subject, v
+	case map[string]interface{}:
+		if s, ok := v["subject"].(string); ok && s != "" {
+			subject = s
+		}
+		if msg, ok := v["msg"].(string); ok {
+			return subject, msg
+		}
+	}
+	content, _ := json.Marshal(value)
+	return subject, string(content)
+}
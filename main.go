@@ -8,10 +8,11 @@ import (
 	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var syncType string
-var releaseCheckUrl, servicenowCheckUrl, gitCommitMessage, token, repoUrl, gitBranch, gitLastCommitId, targetEnvironment string
+var releaseCheckUrl, servicenowCheckUrl, gitCommitMessage, repoUrl, gitBranch, gitLastCommitId, targetEnvironment string
 var submitDeploymentUrl, argocdAppName, argocdNamespace string
 var sealId, deploymentId string
 
@@ -26,6 +27,9 @@ type JobPayload struct {
 	DeploymentId				string `json:"deploymentId"`
 	ProjectName					string `json:"projectName"`
 	ArtifactLocation			string `json:"artifactLocation"`
+	RepoUrl						string `json:"repoUrl,omitempty"`
+	Branch						string `json:"branch,omitempty"`
+	CommitId					string `json:"commitId,omitempty"`
 }
 
 var payloads = make([]string, 0)
@@ -33,59 +37,235 @@ var payloads = make([]string, 0)
 var rootCmd = &cobra.Command{
 	Use:   "policy-job",
 	Short: "This is a go client for performing validating deployments in presync job via policy",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := loadConfiguration(cmd); err != nil {
+			return err
+		}
+		if err := setupHTTPClients(); err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), kubeApiRequestTimeout*time.Second)
+		defer cancel()
+		return loadCredentials(ctx)
+	},
+	// RunE keeps --sync-type working for hook manifests written before the sync subcommands
 	RunE: func(cmd *cobra.Command, args []string) error {
-		if syncType == "presync" {
-			//TODO: the context is cancelled with the timeout, this can be changed to with cancel without the timeout if this starts malfunctioning
-			ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
-			defer cancel()
-
-			if err := RunPresync(ctx); err != nil {
-				return err
-			}
-			return nil
-		} else if syncType == "postsync" {
-			//TODO: the context is cancelled with the timeout, this can be changed to with cancel without the timeout if this starts malfunctioning
-			ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
-			defer cancel()
-
-			if err := RunPostsync(ctx); err != nil {
-				return err
-			}
-			return nil
-		} else {
-			return fmt.Errorf("sync-type should either be presync or postsync")
+		run, ok := syncModes[syncType]
+		if !ok {
+			return fmt.Errorf("sync-type should either be presync, postsync or syncfail")
 		}
+		log.Printf("WARNING: --sync-type is deprecated, use policy-job %s instead", syncType)
+		return runSyncMode(run)
+	},
+}
+
+// syncModes maps each sync type to what its hook runs.
+var syncModes = map[string]func(context.Context) error{
+	"presync":  RunPresync,
+	"postsync": RunPostsync,
+	"syncfail": RunSyncfail,
+}
+
+func runSyncMode(run func(context.Context) error) error {
+	//TODO: the context is cancelled with the timeout, this can be changed to with cancel without the timeout if this starts malfunctioning
+	ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+	defer cancel()
+
+	return run(ctx)
+}
+
+var presyncCmd = &cobra.Command{
+	Use:   "presync",
+	Short: "Validate release readiness, change tickets, images and policies before the sync",
+	Long: `Runs as an argocd PreSync hook and fails the sync when a check fails. It checks release readiness
+through release-check-url, validates the change tickets, and, when configured, the image policy,
+image signatures and provenance and the local rego policies.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runSyncMode(RunPresync)
+	},
+}
+
+var postsyncCmd = &cobra.Command{
+	Use:   "postsync",
+	Short: "Submit the deployed images after a successful sync",
+	Long: `Runs as an argocd PostSync hook. It submits every image as a successful deployment to
+submit-deployment-url and, when configured, adds a work note to the change tickets or moves them
+to change-success-state.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runSyncMode(RunPostsync)
+	},
+}
+
+var syncfailCmd = &cobra.Command{
+	Use:   "syncfail",
+	Short: "Submit the images as a failed deployment after a failed sync",
+	Long: `Runs as an argocd SyncFail hook. It submits every image as a failed deployment carrying the
+operation message and failed resources of the application and, when configured, adds a work note
+to the change tickets or moves them to change-failure-state.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runSyncMode(RunSyncfail)
+	},
+}
+
+var flushCmd = &cobra.Command{
+	Use:   "flush",
+	Short: "Replay deployment submissions spooled by earlier postsync and syncfail runs",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout*time.Second)
+		defer cancel()
+
+		return RunFlush(ctx)
 	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	err := rootCmd.Execute()
+	log.SetOutput(&redactingWriter{w: os.Stderr})
+	rootCmd.SetOut(&redactingWriter{w: os.Stdout})
+	rootCmd.SetErr(&redactingWriter{w: os.Stderr})
+	cmd, err := rootCmd.ExecuteC()
+	mode := syncType
+	if cmd != rootCmd {
+		mode = cmd.Name()
+	}
+	if len(runReport.Results()) > 0 {
+		log.Printf("Run summary:\n%s", runReport.Summary())
+	}
+	writeRunReport(mode, err)
+	recordResultsOnApplication(mode, err)
 	if err != nil {
 		log.Printf("error: %v", err)
-		log.Printf("FAILURE: %s", syncType)
+		log.Printf("FAILURE: %s", mode)
 		os.Exit(1)
 	}
-	log.Printf("SUCCESS: %s", syncType)
+	log.Printf("SUCCESS: %s", mode)
 }
 
 func init() {
-	rootCmd.Flags().StringVarP(&releaseCheckUrl, "release-check-url", "u", "", "release check url")
-	rootCmd.Flags().StringVarP(&servicenowCheckUrl, "servicenow-check-url", "s", "", "servicenow check url")
-	rootCmd.Flags().StringVarP(&submitDeploymentUrl, "submit-deployment-url", "d", "", "submit deployment url")
-	rootCmd.Flags().StringVarP(&gitBranch, "git-branch", "b", "", "git branch")
-	rootCmd.Flags().StringVarP(&gitCommitMessage, "git-last-commit-message", "c", "", "git commit message")
-	rootCmd.Flags().StringVarP(&token, "service-token", "t", "", "service token")
-	rootCmd.Flags().StringArrayVarP(&payloads, "payload", "p", []string{}, "payload")
-	rootCmd.Flags().StringVarP(&syncType, "sync-type", "y", "", "sync type")
-	rootCmd.Flags().StringVarP(&repoUrl, "repo-url", "", "", "repo url")
-	rootCmd.Flags().StringVarP(&gitLastCommitId, "git-last-commitId", "", "", "git last commit id")
-	rootCmd.Flags().StringVarP(&targetEnvironment, "target-environment", "", "", "target environment")
-	rootCmd.Flags().StringVarP(&argocdAppName, "argocd-app-name","","", "argocd application on which the plugin is applied")
-	rootCmd.Flags().StringVarP(&argocdNamespace, "argocd-namespace","","", "namespace where argocd is installed")
+	rootCmd.PersistentFlags().StringVarP(&configFile, configFlag, "", "", "yaml or json file with flag values keyed by flag name, flags and POLICY_JOB_<FLAG> environment variables take precedence")
+	rootCmd.PersistentFlags().StringVarP(&serviceToken.value, "service-token", "t", "", "service token, prefer service-token-from so the token does not show up in the pod spec")
+	rootCmd.PersistentFlags().StringVarP(&serviceToken.source, "service-token-from", "", "", "read the service token from file:<path>, env:<variable> or secret:[<namespace>/]<name>/<key>")
+	rootCmd.Flags().StringVarP(&syncType, "sync-type", "y", "", "sync type, either presync, postsync or syncfail")
+	rootCmd.PersistentFlags().StringVarP(&argocdNamespace, "argocd-namespace","","", "namespace where argocd is installed")
+	rootCmd.PersistentFlags().IntVarP(&submitDeploymentMaxRetries, "submit-deployment-max-retries", "", 3, "retries for failed deployment submissions")
+	rootCmd.PersistentFlags().StringVarP(&submitDeploymentAuth, "submit-deployment-auth", "", "", authFlagUsage)
+	rootCmd.PersistentFlags().StringVarP(&defaultTransport.CAFile, "ca-file", "", "", "PEM bundle trusted in addition to the system roots for every endpoint")
+	rootCmd.PersistentFlags().StringVarP(&defaultTransport.Proxy, "proxy", "", "", "proxy url for every endpoint, none disables the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment")
+	rootCmd.PersistentFlags().StringVarP(&defaultTransport.TLSMinVersion, "tls-min-version", "", defaultTransport.TLSMinVersion, "minimum TLS version, one of 1.0, 1.1, 1.2 or 1.3")
+	rootCmd.PersistentFlags().DurationVarP(&defaultTransport.ConnectTimeout, "connect-timeout", "", defaultTransport.ConnectTimeout, "timeout for establishing a connection, 0 for none")
+	rootCmd.PersistentFlags().DurationVarP(&defaultTransport.TLSHandshakeTimeout, "tls-handshake-timeout", "", defaultTransport.TLSHandshakeTimeout, "timeout for the TLS handshake, 0 for none")
+	rootCmd.PersistentFlags().DurationVarP(&defaultTransport.ResponseHeaderTimeout, "response-header-timeout", "", defaultTransport.ResponseHeaderTimeout, "timeout for the response headers after sending a request, 0 for none")
+	rootCmd.PersistentFlags().DurationVarP(&defaultTransport.RequestTimeout, "request-timeout", "", defaultTransport.RequestTimeout, "timeout for a whole request including its retries, 0 for none")
+	rootCmd.PersistentFlags().StringVarP(&submitDeploymentTransport, "submit-deployment-transport", "", "", transportFlagUsage)
+	rootCmd.PersistentFlags().DurationVarP(&retryBaseDelay, "retry-base-delay", "", time.Second, "delay before the first retry, doubled for every further retry")
+	rootCmd.PersistentFlags().DurationVarP(&retryMaxDelay, "retry-max-delay", "", 30*time.Second, "upper bound for the delay between retries, 0 for none")
+	rootCmd.PersistentFlags().StringVarP(&kubeconfigPath, "kubeconfig", "", "", "kubeconfig to use when not running inside the cluster, defaults to $KUBECONFIG or ~/.kube/config")
+	rootCmd.PersistentFlags().StringVarP(&spoolDir, "spool-dir", "", "", "directory where failed deployment submissions are kept for replay")
+	rootCmd.PersistentFlags().StringVarP(&spoolConfigMap, "spool-configmap", "", "", "configmap in argocd-namespace where failed deployment submissions are kept for replay")
 	// rootCmd.Flags().StringVarP(&sealId, "sealId", "", "", "seal id from manifests")
 	// rootCmd.Flags().StringVarP(&deploymentId, "deploymentId", "", "", "deployment id from manifests")
+	// the root command keeps every flag so hook manifests using --sync-type keep working
+	addSyncFlags(rootCmd.Flags())
+	addChangeFlags(rootCmd.Flags())
+	addPresyncFlags(rootCmd.Flags())
+	addSubmitFlags(rootCmd.Flags())
+
+	addSyncFlags(presyncCmd.Flags())
+	addChangeFlags(presyncCmd.Flags())
+	addPresyncFlags(presyncCmd.Flags())
+	presyncCmd.MarkFlagRequired("argocd-app-name")
+
+	for _, cmd := range []*cobra.Command{postsyncCmd, syncfailCmd} {
+		addSyncFlags(cmd.Flags())
+		addChangeFlags(cmd.Flags())
+		addSubmitFlags(cmd.Flags())
+	}
+	syncfailCmd.MarkFlagRequired("argocd-app-name")
+
+	rootCmd.AddCommand(presyncCmd, postsyncCmd, syncfailCmd, flushCmd)
+}
+
+// addSyncFlags adds the flags every sync mode reads its payloads, images and report settings from.
+func addSyncFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&gitBranch, "git-branch", "b", "", "git branch")
+	flags.StringVarP(&gitCommitMessage, "git-last-commit-message", "c", "", "git commit message")
+	flags.StringArrayVarP(&payloads, "payload", "p", []string{}, "payload")
+	flags.StringVarP(&repoUrl, "repo-url", "", "", "repo url")
+	flags.StringVarP(&gitLastCommitId, "git-last-commitId", "", "", "git last commit id")
+	flags.StringVarP(&targetEnvironment, "target-environment", "", "", "target environment")
+	flags.StringVarP(&argocdAppName, "argocd-app-name", "", "",  "argocd application on which the plugin is applied")
+	flags.BoolVarP(&discoverImages, "discover-images", "", false, "build payloads for the images found on the argocd application in addition to the payload flags")
+	flags.StringVarP(&imageMappingFile, "image-mapping-file", "", "", "yaml or json file mapping image names to jetId, sealId and projectName for discovered images")
+	flags.BoolVarP(&resolveDigests, "resolve-digests", "", false, "resolve every image tag to its manifest digest through the registry, fill artifactId and, when not set, artifactCreateDate")
+	flags.StringVarP(&dockerConfigPath, "docker-config", "", "", "docker config.json with the registry credentials, defaults to $DOCKER_CONFIG/config.json or ~/.docker/config.json")
+	flags.StringArrayVarP(&insecureRegistries, "insecure-registry", "", []string{}, "registry host reached over plain http, can be repeated")
+	flags.IntVarP(&registryMaxRetries, "registry-max-retries", "", 3, "retries for failed registry requests")
+	flags.StringVarP(&registryTransport, "registry-transport", "", "", transportFlagUsage)
+	flags.StringVarP(&reportFile, "report", "", "", "file the run report is written to")
+	flags.StringVarP(&reportFormat, "report-format", "", "", "format of the report file, either json or junit, defaults to junit for .xml files and json otherwise")
+	flags.StringVarP(&reportConfigMap, "report-configmap", "", "", "configmap in argocd-namespace where the json run report is stored per application and sync type")
+	flags.BoolVarP(&reportToAnnotation, "report-annotation", "", false, "store the json run report as the "+reportAnnotation+" annotation of the application, needs patch on the application, replace the my-application placeholder in manifests/argo-app-reader-role.yaml with its name")
+	flags.BoolVarP(&recordOnApplication, "record-on-application", "", false, "emit an event per check result on the application, needs create on events")
+	flags.BoolVarP(&recordLastResult, "last-result-annotation", "", false, "set the "+lastResultAnnotation+" annotation of the application after every run, needs patch on the application, replace the my-application placeholder in manifests/argo-app-reader-role.yaml with its name")
+}
+
+// addChangeFlags adds the flags of the change-management backend, presync validates change tickets
+// and postsync and syncfail update them.
+func addChangeFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&servicenowCheckUrl, "servicenow-check-url", "s", "", "servicenow check url")
+	flags.IntVarP(&servicenowMaxRetries, "servicenow-max-retries", "", 3, "retries for failed servicenow requests")
+	flags.StringVarP(&servicenowAuth, "servicenow-auth", "", "", authFlagUsage+", with change-backend servicenow it replaces servicenow-username and servicenow-client-id")
+	flags.StringVarP(&servicenowTransport, "servicenow-transport", "", "", transportFlagUsage)
+	flags.StringVarP(&changeBackend, "change-backend", "", opsmxChangeBackend, "change-management backend used to validate change tickets, either opsmx (servicenow-check-url proxy) or servicenow (table api)")
+	flags.StringVarP(&serviceNowInstanceUrl, "servicenow-instance-url", "", "", "servicenow instance url for the servicenow change backend, e.g. https://example.service-now.com")
+	flags.StringVarP(&serviceNowUsername, "servicenow-username", "", "", "servicenow user for basic auth, or for the oauth password grant when servicenow-client-id is set")
+	flags.StringVarP(&serviceNowPassword.value, "servicenow-password", "", "", "servicenow password")
+	flags.StringVarP(&serviceNowPassword.source, "servicenow-password-from", "", "", "read the servicenow password from file:<path>, env:<variable> or secret:[<namespace>/]<name>/<key>")
+	flags.StringVarP(&serviceNowClientId, "servicenow-client-id", "", "", "servicenow oauth client id")
+	flags.StringVarP(&serviceNowClientSecret.value, "servicenow-client-secret", "", "", "servicenow oauth client secret")
+	flags.StringVarP(&serviceNowClientSecret.source, "servicenow-client-secret-from", "", "", "read the servicenow oauth client secret from file:<path>, env:<variable> or secret:[<namespace>/]<name>/<key>")
+	flags.StringVarP(&serviceNowIdentifierField, "servicenow-identifier-field", "", "cmdb_ci.correlation_id", "change_request field holding the sealId:deploymentId identifier")
+	flags.StringVarP(&snowIdPattern, "snow-id-pattern", "", defaultSnowIdPattern, "regex used to find servicenow change tickets, every match is validated")
+	flags.StringVarP(&snowIdAnnotation, "snow-id-annotation", "", "", "read servicenow change tickets from this argocd application annotation instead of the commit message")
+}
+
+// addPresyncFlags adds the flags of the checks only presync runs.
+func addPresyncFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&releaseCheckUrl, "release-check-url", "u", "", "release check url")
+	flags.IntVarP(&releaseCheckMaxRetries, "release-check-max-retries", "", 3, "retries for failed release check requests")
+	flags.StringVarP(&releaseCheckAuth, "release-check-auth", "", "", authFlagUsage)
+	flags.StringVarP(&releaseCheckTransport, "release-check-transport", "", "", transportFlagUsage)
+	flags.DurationVarP(&releasePollInterval, "release-poll-interval", "", 0, "keep re-checking release readiness at this interval until it is ready, 0 checks once")
+	flags.Float64VarP(&releasePollBackoff, "release-poll-backoff", "", 1.5, "multiply the release poll interval by this after every attempt")
+	flags.DurationVarP(&releasePollMaxInterval, "release-poll-max-interval", "", 2*time.Minute, "upper bound for the release poll interval")
+	flags.DurationVarP(&releasePollMaxWait, "release-poll-max-wait", "", 0, "give up polling release readiness after this long, 0 polls until the job times out")
+	flags.StringVarP(&changeRulesFile, "change-rules-file", "", "", "yaml or json file with the allowed change states, required approvals and maximum risk")
+	flags.StringVarP(&changeTimezone, "change-timezone", "", "UTC", "timezone of change start and end times that carry no offset, e.g. America/New_York")
+	flags.DurationVarP(&changeWindowEarlyGrace, "change-window-early-grace", "", 0, "allow deployments this long before the change window starts")
+	flags.DurationVarP(&changeWindowLateGrace, "change-window-late-grace", "", 0, "allow deployments this long after the change window ends")
+	flags.DurationVarP(&clockSkewTolerance, "clock-skew-tolerance", "", 0, "widen both ends of the change window by this much for clock differences with servicenow")
+	flags.BoolVarP(&verifySignatures, "verify-signatures", "", false, "verify the cosign signature of every image in presync")
+	flags.StringArrayVarP(&cosignKeyFiles, "cosign-key", "", []string{}, "PEM public key file signatures are verified with, can be repeated")
+	flags.StringArrayVarP(&cosignIdentities, "cosign-identity", "", []string{}, "keyless signer allowed as issuer=<oidc issuer>,subject=<regexp>, can be repeated")
+	flags.StringVarP(&cosignRootsFile, "cosign-roots", "", "", "PEM bundle of the Fulcio root and intermediate certificates for keyless verification")
+	flags.StringVarP(&rekorPublicKeyFile, "rekor-public-key", "", "", "PEM public key of the Rekor transparency log for keyless verification")
+	flags.BoolVarP(&requireProvenance, "require-provenance", "", false, "require a signed SLSA provenance attestation matching repo-url and git-last-commitId")
+	flags.StringVarP(&imagePolicyFile, "image-policy-file", "", "", "yaml or json file with the allowed tags, digests, registries and repositories per target environment")
+	flags.StringArrayVarP(&policyPaths, "policy", "", []string{}, "rego policy file, directory or bundle .tar.gz evaluated by presync, can be repeated")
+	flags.StringVarP(&policyPackage, "policy-package", "", "policyjob", "package of the local policies whose deny and warn rules are evaluated")
+}
+
+// addSubmitFlags adds the flags postsync and syncfail use to submit deployments and update change tickets.
+func addSubmitFlags(flags *pflag.FlagSet) {
+	flags.StringVarP(&submitDeploymentUrl, "submit-deployment-url", "d", "", "submit deployment url")
+	flags.BoolVarP(&changeWorkNote, "change-work-note", "", false, "add a work note with the application, revision and images to the change tickets after the sync")
+	flags.StringVarP(&changeSuccessState, "change-success-state", "", "", "move the change tickets to this state after a successful sync, e.g. Review")
+	flags.StringVarP(&changeFailureState, "change-failure-state", "", "", "move the change tickets to this state after a failed sync")
+	flags.StringVarP(&changeCloseCode, "change-close-code", "", "", "close code set together with the change success or failure state, needed when moving changes to Closed")
 }
 
 func main() {
@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 	"encoding/json"
 )
 
@@ -30,115 +31,196 @@ type DeploymentPayload struct {
 	ExtPayload 							string `json:"extPayload"`
 }
 
+const (
+	deploymentEventSuccess = "SUCCESS"
+	deploymentEventFailure = "FAILURE"
+)
+
+// DeploymentEvent is the outcome of the sync reported with every DeploymentPayload.
+type DeploymentEvent struct {
+	Status     string
+	ExtPayload string
+}
+
 func RunPostsync(ctx context.Context) error {
-	if err := validateInput(); err != nil {
+	if err := validateSubmitInput(true); err != nil {
 		return err
 	}
 
+	var kubeClient *KubeClient
+	if strings.TrimSpace(argocdAppName) != "" {
+		client, err := NewKubeClient()
+		if err != nil && (discoverImages || (strings.TrimSpace(snowIdAnnotation) != "" && changeTransitionEnabled(true))) {
+			return fmt.Errorf("error while creating kubernetes client: %v", err)
+		} else if err != nil {
+			log.Printf("WARNING: could not create kubernetes client, using git-branch and git-last-commitId for every image: %v", err)
+		}
+		kubeClient = client
+	}
+
+	return submitDeployments(ctx, kubeClient, DeploymentEvent{Status: deploymentEventSuccess})
+}
+
+// submitDeployments submits a DeploymentPayload for every job payload and updates the change tickets
+// according to the event status.
+func submitDeployments(ctx context.Context, kubeClient *KubeClient, event DeploymentEvent) error {
 	var wg sync.WaitGroup
-	wgErrorChan := make(chan bool)
+	results := make(chan CheckResult)
 	wgDoneChan := make(chan bool)
 
-	for _, payload := range payloads {
+	jobPayloads, err := loadJobPayloads(ctx, kubeClient)
+	if err != nil {
+		return err
+	}
+
+	spool, err := NewDeploymentSpool(kubeClient)
+	if err != nil {
+		return err
+	}
+	if spool != nil {
+		// deliver what earlier runs could not before adding this run's submissions
+		if remaining, err := replaySpool(ctx, spool); err != nil {
+			log.Printf("WARNING: could not replay spooled deployments: %v", err)
+		} else if remaining > 0 {
+			log.Printf("WARNING: %d spooled deployments are still undelivered", remaining)
+		}
+	}
+
+	// set up before the goroutines start, they would block on results when returning here
+	var snowIds []string
+	var changeManager ChangeManager
+	succeeded := event.Status == deploymentEventSuccess
+	if changeTransitionEnabled(succeeded) {
+		if changeManager, err = NewChangeManager(); err != nil {
+			return err
+		}
+		if snowIds, err = changeTicketIds(ctx, kubeClient); err != nil {
+			runReport.Add(CheckResult{Check: changeTransitionCheck, Subject: "-", Outcome: outcomeError, Message: fmt.Sprintf("error while finding change tickets to update: %v", err)})
+		}
+	}
+
+	for _, jobPayload := range jobPayloads {
 		wg.Add(1)
-		go func(payload string) {
+		go func(jobPayload JobPayload) {
 			defer wg.Done()
 
-			jobPayload := JobPayload{}
-			if err := json.Unmarshal([]byte(payload), &jobPayload); err != nil {
-				log.Printf("error while parsing job payload %v", err)
-				wgErrorChan <- true
-			}
-
 			if(strings.TrimSpace(submitDeploymentUrl) != ""){
-				startSubmitDeploymentSteward(ctx, submitDeploymentUrl, jobPayload, wgErrorChan)
+				startSubmitDeploymentSteward(ctx, submitDeploymentUrl, jobPayload, event, spool, results)
+			} else {
+				results <- CheckResult{Check: submitDeploymentCheck, Subject: payloadSubject(jobPayload), Outcome: outcomeSkipped, Message: "submit-deployment-url is not set"}
 			}
 
-		}(payload)
+		}(jobPayload)
+	}
+
+	for _, snowId := range snowIds {
+		wg.Add(1)
+		go func(snowId string) {
+			defer wg.Done()
+			results <- transitionChangeTicket(ctx, changeManager, snowId, jobPayloads, succeeded)
+		}(snowId)
 	}
 
 	go func() {
 		wg.Wait()
-		wgDoneChan <- true
+		close(wgDoneChan)
 	}()
 
-	areThereAnyErrors := false
-	
-	for {
-		select {
-		case <-wgErrorChan:
-			areThereAnyErrors = true
-		case <-wgDoneChan:
-			if areThereAnyErrors {
-				return fmt.Errorf("")
-			}
-			log.Printf("SUCCESS: Deployment details submitted for JetId: %s","SampleCombinedJetId")
-			return nil
-		}
-	}
+	collectResults(results, wgDoneChan)
+	return runReport.Err()
 }
 
-func MakeDeploymentPayload(payload JobPayload) (string, error) {
-	repoName, err := extractRepoName(repoUrl)
+func MakeDeploymentPayload(payload JobPayload, event DeploymentEvent) (string, error) {
+	repoName, err := extractRepoName(firstNonEmpty(payload.RepoUrl, repoUrl))
 	if(err != nil) {
 		return "", err
 	}
 	deploymentPayload, err := json.Marshal(DeploymentPayload{
-		EventStatus: "SUCCESS",
+		EventStatus: event.Status,
 		DeployTool: "ArgoCD",
 		SealId: payload.SealId,
 		JetId: payload.JetId,
 		RepoName: repoName,
 		ProjectName: payload.ProjectName,
-		Branch: gitBranch,
-		CommitId: gitLastCommitId,
+		Branch: payload.Branch,
+		CommitId: payload.CommitId,
 		SourceUri: payload.ArtifactLocation,
 		ArtifactId: payload.ArtifactId,
 		ArtifactLocation: payload.ArtifactLocation,
 		TargetEnvironment: targetEnvironment,
 		Initiator: "???",
+		ExtPayload: event.ExtPayload,
 	})
 	return string(deploymentPayload), err
 }
 
-func startSubmitDeploymentSteward(ctx context.Context, url string, payload JobPayload, wgErrorChan chan<- bool) {
-	resultChan := make(chan Result)
-	defer close(resultChan)
+// startSubmitDeploymentSteward submits one deployment. A failed submission is written to the spool,
+// when one is configured, and only fails the run if it cannot be spooled either.
+func startSubmitDeploymentSteward(ctx context.Context, url string, payload JobPayload, event DeploymentEvent, spool DeploymentSpool, results chan<- CheckResult) {
+	resultChan := make(chan Result, 1)
+	started := time.Now()
+	var response string
+	report := func(outcome, message string) {
+		results <- CheckResult{Check: submitDeploymentCheck, Subject: payloadSubject(payload), Outcome: outcome, Message: message, Duration: time.Since(started),
+			Url: url, Response: response}
+	}
 
-	deploymentPayload, err := MakeDeploymentPayload(payload)
+	deploymentPayload, err := MakeDeploymentPayload(payload, event)
 	if err != nil {
-		wgErrorChan <- true
+		report(outcomeError, fmt.Sprintf("error building deployment payload: %v", err))
 		return
 	}
+	idempotencyKey := deploymentIdempotencyKey(payload, event)
 
-	go submitDeployment(url, resultChan, deploymentPayload)
+	go submitDeployment(url, resultChan, payload, deploymentPayload, idempotencyKey)
+
+	// fail spools the submission when a spool is configured. The submission may still arrive after a
+	// timeout, the replay then sends the same idempotency key and the receiver drops the duplicate.
+	fail := func(ctx context.Context, cause error) {
+		if spool == nil {
+			report(outcomeError, cause.Error())
+		} else if err := spoolDeployment(ctx, spool, url, idempotencyKey, deploymentPayload, cause); err != nil {
+			log.Printf("ERROR: While spooling deployment %s: %v", idempotencyKey, err)
+			report(outcomeError, fmt.Sprintf("submission failed and could not be spooled: %v", err))
+		} else {
+			log.Printf("WARNING: Deployment %s for Image: %s spooled for replay", idempotencyKey, payload.ArtifactName)
+			report(outcomeWarn, fmt.Sprintf("submission failed, spooled as %s for replay", idempotencyKey))
+		}
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
-			log.Printf("ERROR: Timed out/cancelled for %s", deploymentPayload)
-			wgErrorChan <- true
+			log.Printf("ERROR: Timed out/cancelled for %s", payloadSubject(payload))
+			// ctx is done, so the spool gets a context of its own to write in
+			spoolCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), spoolTimeout)
+			defer cancel()
+			fail(spoolCtx, fmt.Errorf("timed out: %v", ctx.Err()))
 			return
 		case result := <-resultChan:
-			if result.err != nil {
-				wgErrorChan <- true
+			response = result.response
+			if result.err == nil {
+				report(outcomePass, fmt.Sprintf("%s event submitted", event.Status))
+				return
 			}
+			log.Printf("%v", result.err)
+			fail(ctx, result.err)
 			return
 		}
 	}
 }
 
-func submitDeployment(url string, resultChan chan<- Result, payload string) {
-	statusCode, responseBytes , err := postToHost(httpClient, url, token, []byte(payload))
+func submitDeployment(url string, resultChan chan<- Result, jobPayload JobPayload, payload string, idempotencyKey string) {
+	statusCode, responseBytes , err := postToHost(submitDeploymentClient, url, []byte(payload), idempotencyKey)
 	if err != nil {
-		err = fmt.Errorf("ERROR: While submitting deployment payload for JetId: %s and Image: - err: %v", payload, err)
+		err = fmt.Errorf("ERROR: While submitting deployment payload for JetId: %s and Image: %s - err: %v", jobPayload.JetId, jobPayload.ArtifactName, err)
 		resultChan <- Result{err: err}
 		return
 	}
 
 	if statusCode != http.StatusOK {
-		err = fmt.Errorf("ERROR: While submitting deployment payload for JetId: %s and Image: - err: %d", payload, statusCode)
-		resultChan <- Result{err: err}
+		err = fmt.Errorf("ERROR: While submitting deployment payload for JetId: %s and Image: %s - err: %d", jobPayload.JetId, jobPayload.ArtifactName, statusCode)
+		resultChan <- Result{response: string(responseBytes), err: err}
 		return
 	}
 
@@ -146,7 +228,7 @@ func submitDeployment(url string, resultChan chan<- Result, payload string) {
 }
 
 
-func postToHost(c *http.Client, url, token string, serializeddata []byte) (int, []byte, error) {
+func postToHost(c *http.Client, url string, serializeddata []byte, idempotencyKey string) (int, []byte, error) {
 
 	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(serializeddata))
 	if err != nil {
@@ -154,7 +236,9 @@ func postToHost(c *http.Client, url, token string, serializeddata []byte) (int,
 	}
 
 	request.Header.Add("Content-Type", "application/json")
-	request.Header.Add(opsmxToken, token)
+	if idempotencyKey != "" {
+		request.Header.Add(idempotencyKeyHeader, idempotencyKey)
+	}
 
 	resp, err := c.Do(request)
 	if err != nil {
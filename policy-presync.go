@@ -34,6 +34,8 @@ type ServiceNowResponse struct {
 	State 							string `json:"state"`
 	StartTime 						string `json:"startTime"`
 	EndTime							string `json:"endTime"`
+	Approval						string `json:"approval,omitempty"`
+	Risk							string `json:"risk,omitempty"`
 	MainConfigurationItem			MainConfigurationItem `json:"mainConfigurationItem"`
 }
 
@@ -57,67 +59,130 @@ const (
 	timeout    = 600
 )
 
+var releasePollInterval, releasePollMaxInterval, releasePollMaxWait time.Duration
+var releasePollBackoff float64
+
 type Result struct {
 	response string
 	err    error
 }
 
+type ChangeResult struct {
+	change ServiceNowResponse
+	err    error
+}
+
 func RunPresync(ctx context.Context) error {
-	if err := validateInput(); err != nil {
+	if err := validatePresyncInput(); err != nil {
 		return err
 	}
 	var wg sync.WaitGroup
-	wgErrorChan := make(chan bool)
+	results := make(chan CheckResult)
 	wgDoneChan := make(chan bool)
 
 
-	if err := getDeploymentIdAndSealId(); err != nil {
+	kubeClient, err := NewKubeClient()
+	if err != nil {
+		return fmt.Errorf("error while creating kubernetes client: %v", err)
+	}
+
+	if err := getDeploymentIdAndSealId(ctx, kubeClient); err != nil {
 		return fmt.Errorf("error while fetching deploymentId and sealId from application manifest: %v", err)
 	}
 
-	for _, payload := range payloads {
+	jobPayloads, err := loadJobPayloads(ctx, kubeClient)
+	if err != nil {
+		return err
+	}
+
+	imagePolicy, err := loadImagePolicy(imagePolicyFile)
+	if err != nil {
+		return err
+	}
+	if imagePolicy != nil {
+		for _, result := range checkImagePolicy(imagePolicy, jobPayloads) {
+			runReport.Add(result)
+		}
+	}
+
+	signatureVerifier, err := loadSignatureVerifier()
+	if err != nil {
+		return err
+	}
+	if signatureVerifier != nil {
+		for _, result := range checkSignatures(ctx, signatureVerifier, jobPayloads) {
+			runReport.Add(result)
+		}
+	}
+
+	localPolicy, err := loadLocalPolicy(ctx)
+	if err != nil {
+		return err
+	}
+
+	var snowIds []string
+	var changeManager ChangeManager
+	if changeValidationEnabled() {
+		if changeManager, err = NewChangeManager(); err != nil {
+			return err
+		}
+		if changeRules, err = loadChangeRules(changeRulesFile); err != nil {
+			return err
+		}
+		if changeLocation, err = loadChangeLocation(changeTimezone); err != nil {
+			return err
+		}
+		if snowIds, err = changeTicketIds(ctx, kubeClient); err != nil {
+			runReport.Add(CheckResult{Check: serviceNowCheck, Subject: "-", Outcome: outcomeFail, Message: err.Error()})
+		}
+	}
+
+	for _, jobPayload := range jobPayloads {
 		wg.Add(1)
-		go func(payload string) {
+		go func(jobPayload JobPayload) {
 			defer wg.Done()
 
-			var jobPayload JobPayload
-			if err := json.Unmarshal([]byte(payload), &jobPayload); err != nil {
-				log.Printf("error while parsing job payload %v", err)
-				wgErrorChan <- true
-			}
-
 			if(strings.TrimSpace(releaseCheckUrl) != ""){
-				startValidationSteward(ctx, releaseCheckUrl, jobPayload, wgErrorChan)
+				startValidationSteward(ctx, releaseCheckUrl, jobPayload, results)
+			} else {
+				results <- CheckResult{Check: releaseCheck, Subject: payloadSubject(jobPayload), Outcome: outcomeSkipped, Message: "release-check-url is not set"}
 			}
 
-		}(payload)
+		}(jobPayload)
 	}
 
-	if(strings.TrimSpace(servicenowCheckUrl) != "") {
-		go startServiceNowSteward(ctx, servicenowCheckUrl, wgErrorChan)
+	for _, snowId := range snowIds {
+		wg.Add(1)
+		go func(snowId string) {
+			defer wg.Done()
+			startServiceNowSteward(ctx, changeManager, snowId, results)
+		}(snowId)
 	}
 
 	go func() {
 		wg.Wait()
-		wgDoneChan <- true
+		close(wgDoneChan)
 	}()
 
-	areThereAnyErrors := false
-	
-	for {
-		select {
-		case <-wgErrorChan:
-			areThereAnyErrors = true
-		case <-wgDoneChan:
-			if areThereAnyErrors {
-				return fmt.Errorf("")
-			}
-			return nil
+	collectResults(results, wgDoneChan)
+
+	// local policies run last, so their input includes the responses of the remote checks
+	if localPolicy != nil {
+		app, err := kubeClient.GetApplication(ctx, argocdNamespace, argocdAppName)
+		if err != nil {
+			log.Printf("WARNING: could not read application %s for the local policies: %v", argocdAppName, err)
+		}
+		for _, result := range localPolicy.Evaluate(ctx, newPolicyInput("presync", jobPayloads, app, snowIds)) {
+			runReport.Add(result)
 		}
 	}
+	return runReport.Err()
 }
 
 func makeReleasePayload(payload JobPayload) (ReleasePayload, error) {
+	if strings.TrimSpace(payload.ArtifactCreateDate) == "" {
+		return ReleasePayload{}, fmt.Errorf("artifactCreateDate is not set for image %s", payload.ArtifactName)
+	}
 	epoch, err := time.Parse(time.RFC3339,payload.ArtifactCreateDate)
 	if err != nil {
 		return ReleasePayload{}, err
@@ -125,7 +190,7 @@ func makeReleasePayload(payload JobPayload) (ReleasePayload, error) {
 	releasePayload := ReleasePayload{
 		JetId: 					payload.JetId,
 		SealId: 				payload.SealId,
-		Branch:					gitBranch,
+		Branch:					payload.Branch,
 		ArtifactCreateDate: 	int(epoch.Unix()),
 	}
 	return releasePayload, nil
@@ -139,115 +204,157 @@ func makeReleasePayload(payload JobPayload) (ReleasePayload, error) {
 // 	return gitCommitMessage
 // }
 
-func extractSnowId(gitCommitMessage string) string {
-	return gitCommitMessage
-}
-
-func startValidationSteward(ctx context.Context, url string, payload JobPayload, wgErrorChan chan<- bool) {
-	resultChan := make(chan Result)
-	defer close(resultChan)
+// startValidationSteward checks release readiness once, or with --release-poll-interval keeps
+// re-checking with backoff until the release is ready, the maximum wait passes or ctx expires.
+// It sends one release-check result and one result per regulation of the last response.
+func startValidationSteward(ctx context.Context, url string, payload JobPayload, results chan<- CheckResult) {
+	started := time.Now()
+	var regulations []RegulationStatus
+	var lastResponse string
+	var links []string
+	report := func(outcome, message string) {
+		logRegulationStatuses(regulations)
+		results <- CheckResult{Check: releaseCheck, Subject: payloadSubject(payload), Outcome: outcome, Message: message, Duration: time.Since(started),
+			Url: url, Response: lastResponse, Links: links}
+		for _, regulation := range regulations {
+			results <- regulation.CheckResult()
+		}
+	}
 
 	releasePayload, err := makeReleasePayload(payload)
 	if err != nil {
-		wgErrorChan <- true
+		log.Printf("ERROR: While building release payload for JetId: %s and Image: %s - err: %v", payload.JetId, payload.ArtifactName, err)
+		report(outcomeError, fmt.Sprintf("error building release payload: %v", err))
 		return
 	}
 
-	go releaseReadyValidation(url, resultChan, releasePayload)
+	polling := releasePollInterval > 0
+	if polling && releasePollMaxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, releasePollMaxWait)
+		defer cancel()
+	}
+	interval := releasePollInterval
+
+	for attempt := 1; ; attempt++ {
+		// buffered so the request goroutine never blocks once the steward has given up on it
+		resultChan := make(chan Result, 1)
+		go releaseReadyValidation(url, resultChan, releasePayload)
 
-	for {
 		select {
 		case <-ctx.Done():
-			log.Printf("ERROR: Timed out/cancelled for %v", releasePayload)
-			wgErrorChan <- true
+			log.Printf("ERROR: Timed out/cancelled for %s after %d attempts", payloadSubject(payload), attempt)
+			report(outcomeError, fmt.Sprintf("timed out after %d attempts", attempt))
 			return
 		case result := <-resultChan:
+			lastResponse = result.response
 			if result.err != nil {
 				log.Printf("error in sending request for release validation: %v", result.err)
-				wgErrorChan <- true
-			} else {
-				var releaseResponse ReleaseResponse
-				if err := json.Unmarshal([]byte(result.response), &releaseResponse); err != nil {
-					log.Printf("ERROR: While parsing release validation response: %v", err)
-					wgErrorChan <- true
-				} else if !releaseResponse.ReleaseReady {
-					log.Printf("FAILURE: Release check validation failed for JetId: %s and Image: %s", payload.JetId, payload.ArtifactName)
-					wgErrorChan <- true
-				} else {
-					log.Printf("SUCCESS: Release check validation passed for JetId: %s and Image: %s", payload.JetId, payload.ArtifactName)
-				}
+				report(outcomeError, result.err.Error())
+				return
+			}
+			var releaseResponse ReleaseResponse
+			if err := json.Unmarshal([]byte(result.response), &releaseResponse); err != nil {
+				log.Printf("ERROR: While parsing release validation response: %v", err)
+				report(outcomeError, fmt.Sprintf("error parsing release validation response: %v", err))
+				return
+			}
+			if releaseResponse.JetConsoleUrl != "" {
+				links = []string{releaseResponse.JetConsoleUrl}
+			}
+			regulations = evaluateRegulations(payload, releaseResponse.Regulations, releaseResponse.ReleaseReady, time.Now())
+			if releaseResponse.ReleaseReady {
+				log.Printf("SUCCESS: Release check validation passed for JetId: %s and Image: %s", payload.JetId, payload.ArtifactName)
+				report(outcomePass, fmt.Sprintf("release ready after %d attempts", attempt))
+				return
+			}
+			message := strings.Join(releaseResponse.ReleaseReadyMessage, "; ")
+			if onlyPendingRegulations(regulations) {
+				log.Printf("WARNING: Release check for JetId: %s and Image: %s is not ready, but no unmet regulation is enforced yet - %s", payload.JetId, payload.ArtifactName, message)
+				report(outcomeWarn, "not ready only for regulations that are not enforced yet: "+message)
+				return
+			}
+			if !polling {
+				log.Printf("FAILURE: Release check validation failed for JetId: %s and Image: %s - %s", payload.JetId, payload.ArtifactName, message)
+				report(outcomeFail, message)
+				return
 			}
+			log.Printf("attempt %d: release not ready for JetId: %s and Image: %s after %s, checking again in %s - %s",
+				attempt, payload.JetId, payload.ArtifactName, time.Since(started).Round(time.Second), interval, message)
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("FAILURE: Release check validation failed for JetId: %s and Image: %s - not ready after %d attempts in %s", payload.JetId, payload.ArtifactName, attempt, time.Since(started).Round(time.Second))
+			report(outcomeFail, fmt.Sprintf("not ready after %d attempts", attempt))
 			return
+		case <-time.After(interval):
 		}
+		interval = nextPollInterval(interval)
 	}
 }
 
-func startServiceNowSteward(ctx context.Context, url string, wgErrorChan chan<- bool) {
-	resultChan := make(chan Result)
-	defer close(resultChan)
+// nextPollInterval grows interval by --release-poll-backoff, capped at --release-poll-max-interval.
+func nextPollInterval(interval time.Duration) time.Duration {
+	next := time.Duration(float64(interval) * releasePollBackoff)
+	if next < interval {
+		next = interval
+	}
+	if releasePollMaxInterval > 0 && next > releasePollMaxInterval {
+		next = releasePollMaxInterval
+	}
+	return next
+}
 
-	snowId := extractSnowId(gitCommitMessage)
+func startServiceNowSteward(ctx context.Context, changeManager ChangeManager, snowId string, results chan<- CheckResult) {
+	resultChan := make(chan ChangeResult, 1)
+	started := time.Now()
+	var response string
+	report := func(outcome, message string) {
+		results <- CheckResult{Check: serviceNowCheck, Subject: snowId, Outcome: outcome, Message: message, Duration: time.Since(started),
+			Url: changeManagerUrl(), Response: response}
+	}
 
-	go serviceNowValidation(url, resultChan, snowId)
+	go serviceNowValidation(ctx, changeManager, resultChan, snowId)
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Printf("ERROR: Timed out/cancelled for %s", snowId)
-			wgErrorChan <- true
+			report(outcomeError, "timed out")
 			return
 		case result := <-resultChan:
 			if result.err != nil {
 				log.Printf("error in sending request for service now validation: %v", result.err)
-				wgErrorChan <- true
-			} else {
-				var serviceNowResponse ServiceNowResponse
-				if err := json.Unmarshal([]byte(result.response), &serviceNowResponse); err != nil {
-					log.Printf("ERROR: While parsing service now response: %v", err)
-					wgErrorChan <- true
-				} else if !checkServiceNowStatus(serviceNowResponse) {
-					log.Printf("FAILURE: Service now validation failed for SnowId: %s", snowId)
-					wgErrorChan <- true
-				} else {
-					log.Printf("SUCCESS: Service now validation passed for SnowId: %s", snowId)
+				report(outcomeError, result.err.Error())
+				return
+			}
+			if content, err := json.Marshal(result.change); err == nil {
+				response = string(content)
+			}
+			if failures := checkServiceNowStatus(result.change); len(failures) > 0 {
+				log.Printf("FAILURE: Service now validation failed for SnowId: %s", snowId)
+				messages := make([]string, 0, len(failures))
+				for _, failure := range failures {
+					messages = append(messages, failure.String())
 				}
+				report(outcomeFail, strings.Join(messages, "; "))
+			} else {
+				log.Printf("SUCCESS: Service now validation passed for SnowId: %s", snowId)
+				report(outcomePass, fmt.Sprintf("state %s", result.change.State))
 			}
 			return
 		}
 	}
 }
 
-func checkServiceNowStatus(serviceNowResponse ServiceNowResponse) bool {
-	if serviceNowResponse.State == "Implement" {
-		return true
-	}
-	if serviceNowResponse.State != "Scheduled" {
-		return false
-	}
-	endTime, err := time.Parse(time.RFC3339, serviceNowResponse.EndTime)
-	if err != nil {
-		log.Printf("error parsing endTime")
-		return false
-	}
-	startTime, err := time.Parse(time.RFC3339, serviceNowResponse.StartTime)
-	if err != nil {
-		log.Printf("error parsing startTime")
-		return false
-	}
-	if (time.Now().Unix() > endTime.Unix()) || (time.Now().Unix() < startTime.Unix()) {
-		log.Printf("current time is not within time window")
-		return false
+// checkServiceNowStatus evaluates the configured change rules and logs every rule the change fails.
+func checkServiceNowStatus(serviceNowResponse ServiceNowResponse) []ChangeRuleFailure {
+	failures := evaluateChangeRules(changeRules, serviceNowResponse)
+	for _, failure := range failures {
+		log.Printf("change rule %s", failure)
 	}
-	sealIdFromResponse, deploymentIdFromResponse := parseIdentifierField(serviceNowResponse)
-	if sealIdFromResponse != sealId {
-		log.Printf("seal id does not match")
-		return false
-	}
-	if deploymentIdFromResponse != deploymentId {
-		log.Printf("deployment id does not match")
-		return false
-	}
-	return true
+	return failures
 }
 
 func parseIdentifierField(serviceNowResponse ServiceNowResponse) (string, string) {
@@ -260,7 +367,7 @@ func parseIdentifierField(serviceNowResponse ServiceNowResponse) (string, string
 }
 
 func releaseReadyValidation(url string, resultChan chan<- Result, payload ReleasePayload) {
-	statusCode, responseBytes , err := getForReleaseCheckHost(httpClient, url, token, payload.JetId, payload.Branch, payload.SealId, payload.ArtifactCreateDate)
+	statusCode, responseBytes , err := getForReleaseCheckHost(releaseCheckClient, url, payload.JetId, payload.Branch, payload.SealId, payload.ArtifactCreateDate)
 	if err != nil {
 		err = fmt.Errorf("ERROR: While release validation for JetId: %s and Image: - err: %v", payload.JetId, err)
 		resultChan <- Result{err: err}
@@ -269,49 +376,77 @@ func releaseReadyValidation(url string, resultChan chan<- Result, payload Releas
 
 	if statusCode != http.StatusOK {
 		err = fmt.Errorf("ERROR: While release validation for JetId: %s and Image: - err: %d", payload.JetId, statusCode)
-		resultChan <- Result{err: err}
+		resultChan <- Result{response: string(responseBytes), err: err}
 		return
 	}
 
 	resultChan <- Result{response: string(responseBytes)}
 }
 
-func serviceNowValidation(url string, resultChan chan<- Result, snowId string) {
-	statusCode, responseBytes , err := getForServiceNowCheckHost(httpClient, url, token, snowId)
-	if err != nil {
-		err = fmt.Errorf("ERROR: While servicenow validation for SnowId %s - err: %v", snowId, err)
-		resultChan <- Result{err: err}
-		return
-	}
+func serviceNowValidation(ctx context.Context, changeManager ChangeManager, resultChan chan<- ChangeResult, snowId string) {
+	change, err := changeManager.GetChange(ctx, snowId)
+	resultChan <- ChangeResult{change: change, err: err}
+}
 
-	if statusCode != http.StatusOK {
-		err = fmt.Errorf("ERROR: While servicenow validation for SnowId %s - httpstatus code %d", snowId, statusCode)
-		resultChan <- Result{err: err}
-		return
+// validatePayloadInput checks the flags every sync mode builds its payloads from.
+func validatePayloadInput() error {
+	if len(payloads) == 0 && !discoverImages {
+		return errors.New("payload flag has not been set and discover-images is off, there are no images to check")
 	}
 
-	resultChan <- Result{response: string(responseBytes)}
+	if discoverImages && strings.TrimSpace(argocdAppName) == "" {
+		return errors.New("argocd-app-name flag has to be set to discover images from the application")
+	}
+	return nil
 }
 
-func validateInput() error {
-	if strings.TrimSpace(token) == "" {
-		return errors.New("token flag has not been set for the policy-presync binary")
+// validatePresyncInput checks the flags presync needs, the service token only for the endpoints it calls.
+func validatePresyncInput() error {
+	if err := validatePayloadInput(); err != nil {
+		return err
+	}
+	if strings.TrimSpace(argocdAppName) == "" {
+		return errors.New("argocd-app-name flag has to be set to read the sealId and deploymentId of the application")
+	}
+	var endpoints []string
+	if strings.TrimSpace(releaseCheckUrl) != "" {
+		endpoints = append(endpoints, releaseCheckEndpoint)
+	}
+	if changeValidationEnabled() {
+		endpoints = append(endpoints, servicenowEndpoint)
+	}
+	if len(endpoints) == 0 && imagePolicyFile == "" && !verifySignatures && len(policyPaths) == 0 {
+		log.Printf("WARNING: neither release-check-url nor change tickets, image policy, signatures or local policies are configured, presync checks nothing")
 	}
+	return requireServiceToken(endpoints...)
+}
 
-	if len(payloads) == 0 {
-		return errors.New("payload flag has not been set for the policy-presync binary")
+// validateSubmitInput checks the flags postsync and syncfail need to submit deployments and update
+// change tickets, servicenow-check-url and the other presync flags are not needed.
+func validateSubmitInput(succeeded bool) error {
+	if err := validatePayloadInput(); err != nil {
+		return err
 	}
-	return nil
+	if strings.TrimSpace(snowIdAnnotation) != "" && strings.TrimSpace(argocdAppName) == "" {
+		return errors.New("argocd-app-name flag has to be set to read change tickets from the snow-id-annotation")
+	}
+	var endpoints []string
+	if strings.TrimSpace(submitDeploymentUrl) != "" {
+		endpoints = append(endpoints, submitDeploymentEndpoint)
+	}
+	if changeTransitionEnabled(succeeded) {
+		endpoints = append(endpoints, servicenowEndpoint)
+	}
+	return requireServiceToken(endpoints...)
 }
 
-func getForReleaseCheckHost(c *http.Client, url, token string, jetId string, gitBranch string, sealId string, artifactCreateDate int) (int, []byte, error){
+func getForReleaseCheckHost(c *http.Client, url string, jetId string, gitBranch string, sealId string, artifactCreateDate int) (int, []byte, error){
 	request, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return 0, nil, err
 	}
 
 	request.Header.Add("Content-Type", "application/json")
-	request.Header.Add(opsmxToken, token)
 
 	q := request.URL.Query()
 	q.Add("branch", gitBranch)
@@ -335,14 +470,13 @@ func getForReleaseCheckHost(c *http.Client, url, token string, jetId string, git
 	return resp.StatusCode, content, nil
 }
 
-func getForServiceNowCheckHost(c *http.Client, url, token string, snowId string) (int, []byte, error){
+func getForServiceNowCheckHost(c *http.Client, url string, snowId string) (int, []byte, error){
 	request, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
 		return 0, nil, err
 	}
 
 	request.Header.Add("Content-Type", "application/json")
-	request.Header.Add(opsmxToken, token)
 
 	q := request.URL.Query()
 	q.Add("snowId", snowId)
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// SyncFailure is sent as the extPayload of the DeploymentPayload when a sync fails.
+type SyncFailure struct {
+	Phase           string               `json:"phase"`
+	Message         string               `json:"message"`
+	Revision        string               `json:"revision,omitempty"`
+	FailedResources []ResourceSyncResult `json:"failedResources"`
+}
+
+// RunSyncfail runs as an argocd SyncFail hook. It submits every image as a failed deployment,
+// carrying the operation message and the resources that failed to sync.
+func RunSyncfail(ctx context.Context) error {
+	if strings.TrimSpace(argocdAppName) == "" {
+		return errors.New("argocd-app-name flag has to be set to report a failed sync")
+	}
+	if err := validateSubmitInput(false); err != nil {
+		return err
+	}
+
+	kubeClient, err := NewKubeClient()
+	if err != nil {
+		return fmt.Errorf("error while creating kubernetes client: %v", err)
+	}
+
+	app, err := kubeClient.GetApplication(ctx, argocdNamespace, argocdAppName)
+	if err != nil {
+		return fmt.Errorf("error while fetching application %s: %v", argocdAppName, err)
+	}
+
+	syncFailure := makeSyncFailure(app)
+	log.Printf("sync of application %s failed in phase %s: %s", argocdAppName, syncFailure.Phase, syncFailure.Message)
+	for _, resource := range syncFailure.FailedResources {
+		log.Printf("failed resource %s/%s in namespace %s: %s", resource.Kind, resource.Name, resource.Namespace, resource.Message)
+	}
+
+	extPayload, err := json.Marshal(syncFailure)
+	if err != nil {
+		return err
+	}
+	return submitDeployments(ctx, kubeClient, DeploymentEvent{Status: deploymentEventFailure, ExtPayload: string(extPayload)})
+}
+
+func makeSyncFailure(app *Application) SyncFailure {
+	syncFailure := SyncFailure{FailedResources: []ResourceSyncResult{}}
+	operationState := app.Status.OperationState
+	if operationState == nil {
+		syncFailure.Message = "application has no operation state"
+		return syncFailure
+	}
+	syncFailure.Phase = operationState.Phase
+	syncFailure.Message = operationState.Message
+	if operationState.SyncResult == nil {
+		return syncFailure
+	}
+	syncFailure.Revision = firstNonEmpty(operationState.SyncResult.Revision, strings.Join(operationState.SyncResult.Revisions, ","))
+	for _, resource := range operationState.SyncResult.Resources {
+		if isFailedResource(resource) {
+			syncFailure.FailedResources = append(syncFailure.FailedResources, resource)
+		}
+	}
+	return syncFailure
+}
+
+func isFailedResource(resource ResourceSyncResult) bool {
+	switch resource.HookPhase {
+	case "Failed", "Error":
+		return true
+	}
+	return resource.Status == "SyncFailed"
+}
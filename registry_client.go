@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dockerHubRegistry    = "registry-1.docker.io"
+	dockerHubConfigKey   = "https://index.docker.io/v1/"
+	ociImageIndex        = "application/vnd.oci.image.index.v1+json"
+	ociImageManifest     = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestList   = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerManifest       = "application/vnd.docker.distribution.manifest.v2+json"
+	contentDigestHeader  = "Docker-Content-Digest"
+	maxRegistryManifest  = 4 << 20
+	defaultImagePlatform = "linux/amd64"
+)
+
+var resolveDigests bool
+var dockerConfigPath string
+var insecureRegistries []string
+var registryMaxRetries int
+
+// RegistryClient reads manifests and image configs through the OCI distribution (registry v2) api,
+// authenticating with the credentials of a docker config.json.
+type RegistryClient struct {
+	httpClient  *http.Client
+	credentials map[string]registryCredential
+	insecure    map[string]bool
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+type registryCredential struct {
+	username      string
+	password      string
+	identityToken string
+}
+
+// DockerConfig is the part of ~/.docker/config.json the registry client uses. Credential helpers
+// and stores are not supported, only credentials stored in the file itself.
+type DockerConfig struct {
+	Auths map[string]DockerConfigAuth `json:"auths"`
+}
+
+type DockerConfigAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+type registryManifest struct {
+	MediaType string               `json:"mediaType"`
+	Config    registryDescriptor   `json:"config"`
+	Layers    []registryDescriptor `json:"layers"`
+	Manifests []registryDescriptor `json:"manifests"`
+}
+
+type registryDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Platform    *registryPlatform `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type registryPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+type imageConfig struct {
+	Created string `json:"created"`
+}
+
+// ResolvedImage is the manifest digest of an image and the creation time from its config.
+type ResolvedImage struct {
+	Digest  string
+	Created string
+}
+
+// NewRegistryClient loads the credentials of the docker config.json given by --docker-config,
+// $DOCKER_CONFIG or ~/.docker, a missing file means anonymous access.
+func NewRegistryClient(httpClient *http.Client) (*RegistryClient, error) {
+	client := &RegistryClient{
+		httpClient:  httpClient,
+		credentials: make(map[string]registryCredential),
+		insecure:    make(map[string]bool),
+		tokens:      make(map[string]string),
+	}
+	for _, host := range insecureRegistries {
+		client.insecure[host] = true
+	}
+
+	path := dockerConfigFile()
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return client, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading docker config %s: %v", path, err)
+	}
+	var config DockerConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("error parsing docker config %s: %v", path, err)
+	}
+	for key, auth := range config.Auths {
+		credential := registryCredential{username: auth.Username, password: auth.Password, identityToken: auth.IdentityToken}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding auth of %s in docker config %s: %v", key, path, err)
+			}
+			credential.username, credential.password, _ = strings.Cut(string(decoded), ":")
+		}
+		registerSecret(credential.password)
+		registerSecret(credential.identityToken)
+		client.credentials[registryConfigHost(key)] = credential
+	}
+	return client, nil
+}
+
+func dockerConfigFile() string {
+	if dockerConfigPath != "" {
+		return dockerConfigPath
+	}
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".docker", "config.json")
+}
+
+// registryConfigHost normalises a docker config auths key, which may be a url, to a registry host.
+func registryConfigHost(key string) string {
+	if key == dockerHubConfigKey {
+		return defaultRegistry
+	}
+	host := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	host, _, _ = strings.Cut(host, "/")
+	if host == "index.docker.io" || host == dockerHubRegistry {
+		return defaultRegistry
+	}
+	return host
+}
+
+// Resolve returns the digest the tag (or digest) of image points to, and the creation time of
+// the image. For a multi platform index the digest is that of the index, the creation time is
+// read from the linux/amd64 image or the first one listed.
+func (c *RegistryClient) Resolve(ctx context.Context, image ImageReference) (ResolvedImage, error) {
+	reference := image.Digest
+	if reference == "" {
+		reference = firstNonEmpty(image.Tag, impliedImageTag)
+	}
+	manifest, digest, err := c.getManifest(ctx, image, reference)
+	if err != nil {
+		return ResolvedImage{}, err
+	}
+	resolved := ResolvedImage{Digest: digest}
+
+	if len(manifest.Manifests) > 0 {
+		platformDigest := manifest.Manifests[0].Digest
+		for _, descriptor := range manifest.Manifests {
+			if descriptor.Platform != nil && descriptor.Platform.OS+"/"+descriptor.Platform.Architecture == defaultImagePlatform {
+				platformDigest = descriptor.Digest
+				break
+			}
+		}
+		if manifest, _, err = c.getManifest(ctx, image, platformDigest); err != nil {
+			return ResolvedImage{}, err
+		}
+	}
+	if manifest.Config.Digest == "" {
+		return resolved, nil
+	}
+
+	var config imageConfig
+	if _, err := c.get(ctx, image, "/blobs/"+manifest.Config.Digest, "", &config); err != nil {
+		return ResolvedImage{}, fmt.Errorf("error reading config of %s: %v", image, err)
+	}
+	if config.Created != "" {
+		created, err := time.Parse(time.RFC3339Nano, config.Created)
+		if err != nil {
+			return ResolvedImage{}, fmt.Errorf("invalid created time %q in config of %s: %v", config.Created, image, err)
+		}
+		resolved.Created = created.UTC().Format(time.RFC3339)
+	}
+	return resolved, nil
+}
+
+func (c *RegistryClient) getManifest(ctx context.Context, image ImageReference, reference string) (registryManifest, string, error) {
+	var manifest registryManifest
+	accept := strings.Join([]string{ociImageIndex, ociImageManifest, dockerManifestList, dockerManifest}, ", ")
+	digest, err := c.get(ctx, image, "/manifests/"+reference, accept, &manifest)
+	if err != nil {
+		return registryManifest{}, "", fmt.Errorf("error reading manifest %s of %s: %w", reference, image.Name(), err)
+	}
+	return manifest, digest, nil
+}
+
+// get fetches path below the repository of image into out and returns the digest of the content.
+func (c *RegistryClient) get(ctx context.Context, image ImageReference, path, accept string, out interface{}) (string, error) {
+	content, digest, err := c.fetch(ctx, image, path, accept)
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(content, out); err != nil {
+		return "", err
+	}
+	return digest, nil
+}
+
+// getBlob fetches the blob digest of the repository of image and checks its content against the digest.
+func (c *RegistryClient) getBlob(ctx context.Context, image ImageReference, digest string) ([]byte, error) {
+	content, _, err := c.fetch(ctx, image, "/blobs/"+digest, "")
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(content)
+	if "sha256:"+hex.EncodeToString(sum[:]) != digest {
+		return nil, fmt.Errorf("content of blob %s does not match its digest", digest)
+	}
+	return content, nil
+}
+
+// fetch reads path below the repository of image, authenticating on demand when the registry asks
+// for it, and returns the content with its digest. A missing path returns an error wrapping ErrNotFound.
+func (c *RegistryClient) fetch(ctx context.Context, image ImageReference, path, accept string) ([]byte, string, error) {
+	host := image.Registry
+	if host == defaultRegistry {
+		host = dockerHubRegistry
+	}
+	scheme := "https"
+	if c.insecure[image.Registry] {
+		scheme = "http"
+	}
+	requestUrl := fmt.Sprintf("%s://%s/v2/%s%s", scheme, host, image.Repository, path)
+
+	var resp *http.Response
+	for attempt := 0; attempt < 2; attempt++ {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, requestUrl, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		if accept != "" {
+			request.Header.Set("Accept", accept)
+		}
+		c.authorize(request, image)
+		if resp, err = c.httpClient.Do(request); err != nil {
+			return nil, "", err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			break
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := c.authenticate(ctx, image, challenge); err != nil {
+			return nil, "", err
+		}
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxRegistryManifest))
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", fmt.Errorf("registry returned %s: %w", resp.Status, ErrNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("registry returned %s", resp.Status)
+	}
+	digest := resp.Header.Get(contentDigestHeader)
+	if digest == "" {
+		sum := sha256.Sum256(content)
+		digest = "sha256:" + hex.EncodeToString(sum[:])
+	}
+	return content, digest, nil
+}
+
+func (c *RegistryClient) authorize(request *http.Request, image ImageReference) {
+	c.mu.Lock()
+	token := c.tokens[image.Registry+"/"+image.Repository]
+	c.mu.Unlock()
+	if token != "" {
+		request.Header.Set("Authorization", token)
+	}
+}
+
+// authenticate answers a WWW-Authenticate challenge, fetching a bearer token from the realm of the
+// registry or falling back to basic auth, and caches the result per repository.
+func (c *RegistryClient) authenticate(ctx context.Context, image ImageReference, challenge string) error {
+	credential, hasCredential := c.credentials[image.Registry]
+	scheme, params := parseAuthChallenge(challenge)
+	var authorization string
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if !hasCredential {
+			return fmt.Errorf("registry %s requires credentials and none are configured in %s", image.Registry, dockerConfigFile())
+		}
+		authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(credential.username+":"+credential.password))
+	case "bearer":
+		token, err := c.fetchToken(ctx, image, params, credential, hasCredential)
+		if err != nil {
+			return err
+		}
+		authorization = "Bearer " + token
+	default:
+		return fmt.Errorf("registry %s returned 401 with unsupported challenge %q", image.Registry, challenge)
+	}
+	c.mu.Lock()
+	c.tokens[image.Registry+"/"+image.Repository] = authorization
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *RegistryClient) fetchToken(ctx context.Context, image ImageReference, params map[string]string, credential registryCredential, hasCredential bool) (string, error) {
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("registry %s returned a bearer challenge without realm", image.Registry)
+	}
+	tokenUrl, err := url.Parse(realm)
+	if err != nil {
+		return "", fmt.Errorf("invalid token realm %q of registry %s: %v", realm, image.Registry, err)
+	}
+	query := tokenUrl.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", firstNonEmpty(params["scope"], fmt.Sprintf("repository:%s:pull", image.Repository)))
+	tokenUrl.RawQuery = query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenUrl.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if hasCredential {
+		if credential.identityToken != "" {
+			request.Header.Set("Authorization", "Bearer "+credential.identityToken)
+		} else {
+			request.SetBasicAuth(credential.username, credential.password)
+		}
+	}
+	resp, err := c.httpClient.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("error requesting registry token from %s: %v", tokenUrl.Redacted(), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token endpoint %s returned %s", tokenUrl.Redacted(), resp.Status)
+	}
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", fmt.Errorf("error parsing registry token response: %v", err)
+	}
+	token := firstNonEmpty(tokenResponse.Token, tokenResponse.AccessToken)
+	if token == "" {
+		return "", fmt.Errorf("registry token endpoint %s returned no token", tokenUrl.Redacted())
+	}
+	return token, nil
+}
+
+// parseAuthChallenge splits a WWW-Authenticate header like Bearer realm="...",service="..." into
+// its scheme and parameters.
+func parseAuthChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := make(map[string]string)
+	for len(rest) > 0 {
+		rest = strings.TrimLeft(rest, " ,")
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end == -1 {
+				params[strings.ToLower(key)] = value[1:]
+				break
+			}
+			params[strings.ToLower(key)] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			value, rest, _ = strings.Cut(value, ",")
+			params[strings.ToLower(key)] = value
+		}
+	}
+	return scheme, params
+}
+
+// resolveArtifactDigests fills ArtifactId with the manifest digest of every payload image and
+// ArtifactCreateDate from the image config when it is not set. A caller supplied digest that does
+// not match the registry fails the run.
+func resolveArtifactDigests(ctx context.Context, jobPayloads []JobPayload) error {
+	client, err := NewRegistryClient(registryClient)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i := range jobPayloads {
+		payload := &jobPayloads[i]
+		image, err := parseImageReference(payload.ArtifactName)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error parsing image %s: %v", payload.ArtifactName, err))
+			continue
+		}
+		image.Tag = firstNonEmpty(payload.ArtifactTag, image.Tag)
+		supplied := payload.ArtifactId
+		if !strings.HasPrefix(supplied, "sha256:") {
+			supplied = image.Digest
+		}
+		image.Digest = ""
+
+		resolved, err := client.Resolve(ctx, image)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error resolving digest of %s: %v", image, err))
+			continue
+		}
+		if supplied != "" && supplied != resolved.Digest {
+			errs = append(errs, fmt.Errorf("artifactId %s of %s does not match digest %s in the registry", supplied, image, resolved.Digest))
+			continue
+		}
+		payload.ArtifactId = resolved.Digest
+		if strings.TrimSpace(payload.ArtifactCreateDate) == "" && resolved.Created != "" {
+			payload.ArtifactCreateDate = resolved.Created
+		}
+		log.Printf("resolved %s to %s, created %s", image, resolved.Digest, firstNonEmpty(payload.ArtifactCreateDate, "unknown"))
+	}
+	return errors.Join(errs...)
+}
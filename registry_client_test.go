@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func sha256Digest(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// newTestRegistryClient reads credentials for host from a docker config in a temporary directory
+// and talks plain http to it.
+func newTestRegistryClient(t *testing.T, host, username, password string) *RegistryClient {
+	t.Helper()
+	savedPath, savedInsecure := dockerConfigPath, insecureRegistries
+	t.Cleanup(func() { dockerConfigPath, insecureRegistries = savedPath, savedInsecure })
+	dockerConfigPath = filepath.Join(t.TempDir(), "config.json")
+	insecureRegistries = []string{host}
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	writeFile(t, dockerConfigPath, []byte(fmt.Sprintf(`{"auths":{"http://%s/v1/":{"auth":%q}}}`, host, auth)))
+
+	client, err := NewRegistryClient(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func testImage(t *testing.T, server *httptest.Server, tag string) ImageReference {
+	t.Helper()
+	image, err := parseImageReference(strings.TrimPrefix(server.URL, "http://") + "/team/app" + tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return image
+}
+
+func TestRegistryResolveWithBearerToken(t *testing.T) {
+	const config = `{"created":"2024-04-30T18:15:00.123+02:00"}`
+	amd64Manifest := fmt.Sprintf(`{"mediaType":%q,"config":{"digest":%q}}`, ociImageManifest, sha256Digest(config))
+	index := fmt.Sprintf(`{"mediaType":%q,"manifests":[
+		{"digest":"sha256:arm","platform":{"os":"linux","architecture":"arm64"}},
+		{"digest":%q,"platform":{"os":"linux","architecture":"amd64"}}]}`, ociImageIndex, sha256Digest(amd64Manifest))
+	const indexDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	tokens := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokens++
+			if username, password, ok := r.BasicAuth(); !ok || username != "puller" || password != "pull-secret" {
+				t.Errorf("token request authenticated as %q, %q, %v", username, password, ok)
+			}
+			if r.URL.Query().Get("service") != "test-registry" || r.URL.Query().Get("scope") != "repository:team/app:pull" {
+				t.Errorf("unexpected token request %s", r.URL.RawQuery)
+			}
+			fmt.Fprint(w, `{"token":"registry-token"}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer registry-token" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test-registry"`, server.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/team/app/manifests/1.0":
+			if !strings.Contains(r.Header.Get("Accept"), ociImageIndex) {
+				t.Errorf("manifest requested without accepting an index: %q", r.Header.Get("Accept"))
+			}
+			w.Header().Set(contentDigestHeader, indexDigest)
+			fmt.Fprint(w, index)
+		case "/v2/team/app/manifests/" + sha256Digest(amd64Manifest):
+			fmt.Fprint(w, amd64Manifest)
+		case "/v2/team/app/blobs/" + sha256Digest(config):
+			fmt.Fprint(w, config)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	client := newTestRegistryClient(t, strings.TrimPrefix(server.URL, "http://"), "puller", "pull-secret")
+
+	for i := 0; i < 2; i++ {
+		resolved, err := client.Resolve(context.Background(), testImage(t, server, ":1.0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ResolvedImage{Digest: indexDigest, Created: "2024-04-30T16:15:00Z"}
+		if resolved != want {
+			t.Errorf("Resolve = %+v, want %+v", resolved, want)
+		}
+	}
+	if tokens != 1 {
+		t.Errorf("requested %d tokens, want the token to be cached after the first", tokens)
+	}
+}
+
+func TestRegistryResolveWithBasicAuth(t *testing.T) {
+	manifest := fmt.Sprintf(`{"mediaType":%q}`, dockerManifest)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "puller" || password != "pull-secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/v2/team/app/manifests/latest" {
+			http.NotFound(w, r)
+			return
+		}
+		// without Docker-Content-Digest the digest is computed from the manifest
+		fmt.Fprint(w, manifest)
+	}))
+	defer server.Close()
+	client := newTestRegistryClient(t, strings.TrimPrefix(server.URL, "http://"), "puller", "pull-secret")
+
+	resolved, err := client.Resolve(context.Background(), testImage(t, server, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Digest != sha256Digest(manifest) || resolved.Created != "" {
+		t.Errorf("Resolve = %+v, want digest %s", resolved, sha256Digest(manifest))
+	}
+
+	if _, err := client.Resolve(context.Background(), testImage(t, server, ":missing")); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a 404 error for a missing tag, got %v", err)
+	}
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	scheme, params := parseAuthChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:team/app:pull,push"`)
+	if scheme != "Bearer" || params["realm"] != "https://auth.example.com/token" || params["service"] != "registry.example.com" || params["scope"] != "repository:team/app:pull,push" {
+		t.Errorf("parseAuthChallenge = %s, %v", scheme, params)
+	}
+}
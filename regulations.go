@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	regulationSatisfied    = "satisfied"
+	regulationNotEffective = "not-effective"
+	regulationWarning      = "warning"
+	regulationBlocking     = "blocking"
+)
+
+// RegulationStatus is the evaluation of one regulation from a release check response.
+type RegulationStatus struct {
+	JetId        string
+	Image        string
+	RegulationId string
+	Status       string
+	Message      string
+}
+
+// evaluateRegulations classifies every regulation of a release check response. The release check
+// lists the regulations that apply to the release and reports readiness for all of them together,
+// so a ready release satisfies every regulation. For a release that is not ready each regulation
+// blocks the sync once its enforcement date has passed and only warns between its effective and
+// enforcement dates.
+func evaluateRegulations(payload JobPayload, regulations []Regulation, releaseReady bool, now time.Time) []RegulationStatus {
+	statuses := make([]RegulationStatus, 0, len(regulations))
+	for _, regulation := range regulations {
+		effective := regulationTime(regulation.EffectiveDate)
+		enforced := regulationTime(regulation.EnforcementDate)
+		status := RegulationStatus{JetId: payload.JetId, Image: payload.ArtifactName, RegulationId: regulation.RegulationId}
+		switch {
+		case releaseReady:
+			status.Status = regulationSatisfied
+			status.Message = "satisfied"
+		case regulation.EnforcementDate != 0 && !now.Before(enforced):
+			status.Status = regulationBlocking
+			status.Message = fmt.Sprintf("not satisfied and enforced since %s", enforced.Format("2006-01-02"))
+		case regulation.EffectiveDate != 0 && now.Before(effective):
+			status.Status = regulationNotEffective
+			status.Message = fmt.Sprintf("not satisfied, effective from %s", effective.Format("2006-01-02"))
+		case regulation.EnforcementDate != 0:
+			status.Status = regulationWarning
+			days := int(math.Ceil(enforced.Sub(now).Hours() / 24))
+			status.Message = fmt.Sprintf("not satisfied, enforced in %d days on %s", days, enforced.Format("2006-01-02"))
+		default:
+			status.Status = regulationWarning
+			status.Message = "not satisfied, no enforcement date"
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// regulationTime converts a regulation date, accepting both epoch seconds and epoch milliseconds.
+func regulationTime(epoch int) time.Time {
+	if epoch > 1e11 {
+		return time.UnixMilli(int64(epoch))
+	}
+	return time.Unix(int64(epoch), 0)
+}
+
+// onlyPendingRegulations reports whether a release that is not ready is held back only by
+// regulations that are not enforced yet, which warns instead of failing the release check.
+func onlyPendingRegulations(statuses []RegulationStatus) bool {
+	if len(statuses) == 0 {
+		return false
+	}
+	for _, status := range statuses {
+		if status.Status == regulationBlocking {
+			return false
+		}
+	}
+	return true
+}
+
+func logRegulationStatuses(statuses []RegulationStatus) {
+	for _, status := range statuses {
+		switch status.Status {
+		case regulationBlocking:
+			log.Printf("FAILURE: Regulation %s for JetId: %s and Image: %s - %s", status.RegulationId, status.JetId, status.Image, status.Message)
+		case regulationWarning:
+			log.Printf("WARNING: Regulation %s for JetId: %s and Image: %s - %s", status.RegulationId, status.JetId, status.Image, status.Message)
+		}
+	}
+}
+
+// CheckResult converts the status for the run report, a blocking regulation fails the run.
+func (s RegulationStatus) CheckResult() CheckResult {
+	outcome := outcomeWarn
+	switch s.Status {
+	case regulationSatisfied:
+		outcome = outcomePass
+	case regulationNotEffective:
+		outcome = outcomeSkipped
+	case regulationBlocking:
+		outcome = outcomeFail
+	}
+	return CheckResult{
+		Check:   regulationCheck,
+		Subject: fmt.Sprintf("%s for %s", s.RegulationId, s.Image),
+		Outcome: outcome,
+		Message: s.Message,
+	}
+}
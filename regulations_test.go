@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRegulationTime(t *testing.T) {
+	for _, test := range []struct {
+		epoch int
+		want  time.Time
+	}{
+		{0, time.Unix(0, 0)},
+		{1714521600, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		// seconds stay seconds up to 1e11, which is in the year 5138
+		{1e11, time.Unix(1e11, 0)},
+		{1e11 + 1, time.UnixMilli(1e11 + 1)},
+		{1714521600000, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{1714521600123, time.Date(2024, 5, 1, 0, 0, 0, 123e6, time.UTC)},
+	} {
+		if got := regulationTime(test.epoch); !got.Equal(test.want) {
+			t.Errorf("regulationTime(%d) = %s, want %s", test.epoch, got.UTC(), test.want)
+		}
+	}
+}
+
+func TestEvaluateRegulations(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(t time.Time) int { return int(t.Unix()) }
+	atMillis := func(t time.Time) int { return int(t.UnixMilli()) }
+	for _, test := range []struct {
+		name       string
+		regulation Regulation
+		ready      bool
+		status     string
+		message    string
+	}{
+		{
+			name:       "ready release satisfies an enforced regulation",
+			regulation: Regulation{EffectiveDate: at(now.AddDate(0, -2, 0)), EnforcementDate: at(now.AddDate(0, -1, 0))},
+			ready:      true,
+			status:     regulationSatisfied,
+			message:    "satisfied",
+		},
+		{
+			name:       "enforced before now blocks",
+			regulation: Regulation{EffectiveDate: at(now.AddDate(0, -2, 0)), EnforcementDate: at(now.AddDate(0, 0, -1))},
+			status:     regulationBlocking,
+			message:    "not satisfied and enforced since 2024-04-30",
+		},
+		{
+			name:       "enforced exactly now blocks",
+			regulation: Regulation{EffectiveDate: at(now.AddDate(0, -2, 0)), EnforcementDate: at(now)},
+			status:     regulationBlocking,
+			message:    "not satisfied and enforced since 2024-05-01",
+		},
+		{
+			name:       "enforcement in milliseconds",
+			regulation: Regulation{EnforcementDate: atMillis(now.Add(-time.Hour))},
+			status:     regulationBlocking,
+			message:    "not satisfied and enforced since 2024-05-01",
+		},
+		{
+			name:       "effective but not enforced warns with the days left",
+			regulation: Regulation{EffectiveDate: at(now.AddDate(0, 0, -3)), EnforcementDate: at(now.AddDate(0, 0, 10))},
+			status:     regulationWarning,
+			message:    "not satisfied, enforced in 10 days on 2024-05-11",
+		},
+		{
+			name:       "part of a day left rounds up",
+			regulation: Regulation{EffectiveDate: at(now.AddDate(0, 0, -3)), EnforcementDate: at(now.Add(time.Second))},
+			status:     regulationWarning,
+			message:    "not satisfied, enforced in 1 days on 2024-05-01",
+		},
+		{
+			name:       "effective exactly now warns",
+			regulation: Regulation{EffectiveDate: at(now), EnforcementDate: atMillis(now.AddDate(0, 0, 2))},
+			status:     regulationWarning,
+			message:    "not satisfied, enforced in 2 days on 2024-05-03",
+		},
+		{
+			name:       "not effective yet",
+			regulation: Regulation{EffectiveDate: at(now.Add(time.Second)), EnforcementDate: at(now.AddDate(0, 1, 0))},
+			status:     regulationNotEffective,
+			message:    "not satisfied, effective from 2024-05-01",
+		},
+		{
+			name:       "no dates",
+			regulation: Regulation{},
+			status:     regulationWarning,
+			message:    "not satisfied, no enforcement date",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			test.regulation.RegulationId = "SOX-1"
+			statuses := evaluateRegulations(JobPayload{JetId: "jet-1", ArtifactName: "api"}, []Regulation{test.regulation}, test.ready, now)
+			if len(statuses) != 1 {
+				t.Fatalf("got %d statuses, want 1", len(statuses))
+			}
+			got := statuses[0]
+			if got.Status != test.status || got.Message != test.message || got.RegulationId != "SOX-1" || got.JetId != "jet-1" || got.Image != "api" {
+				t.Errorf("got %+v, want status %s and message %q", got, test.status, test.message)
+			}
+		})
+	}
+}
+
+func TestOnlyPendingRegulations(t *testing.T) {
+	for _, test := range []struct {
+		statuses []string
+		want     bool
+	}{
+		{nil, false},
+		{[]string{regulationWarning}, true},
+		{[]string{regulationWarning, regulationNotEffective}, true},
+		{[]string{regulationWarning, regulationBlocking}, false},
+	} {
+		statuses := make([]RegulationStatus, 0, len(test.statuses))
+		for _, status := range test.statuses {
+			statuses = append(statuses, RegulationStatus{Status: status})
+		}
+		if got := onlyPendingRegulations(statuses); got != test.want {
+			t.Errorf("onlyPendingRegulations(%v) = %v, want %v", test.statuses, got, test.want)
+		}
+	}
+}
+
+func TestRegulationCheckResult(t *testing.T) {
+	for status, want := range map[string]string{
+		regulationSatisfied:    outcomePass,
+		regulationNotEffective: outcomeSkipped,
+		regulationWarning:      outcomeWarn,
+		regulationBlocking:     outcomeFail,
+	} {
+		if got := (RegulationStatus{Status: status}).CheckResult().Outcome; got != want {
+			t.Errorf("%s: outcome %s, want %s", status, got, want)
+		}
+	}
+}
+
+func TestReleaseCheckRegulations(t *testing.T) {
+	day := 24 * time.Hour
+	past, future := int(time.Now().Add(-day).Unix()), int(time.Now().Add(10*day).Unix())
+	for _, test := range []struct {
+		name     string
+		response string
+		want     string
+	}{
+		{"ready", fmt.Sprintf(`{"releaseReady":true,"regulations":[{"regulationId":"SOX-1","enforcementDate":%d}]}`, past), outcomePass},
+		{"not ready, regulation not enforced yet", fmt.Sprintf(`{"releaseReady":false,"releaseReadyMessage":["SOX-1 missing"],"regulations":[{"regulationId":"SOX-1","effectiveDate":%d,"enforcementDate":%d}]}`, past, future), outcomeWarn},
+		{"not ready, regulation enforced", fmt.Sprintf(`{"releaseReady":false,"releaseReadyMessage":["SOX-1 missing"],"regulations":[{"regulationId":"SOX-1","enforcementDate":%d}]}`, past), outcomeFail},
+		{"not ready without regulations", `{"releaseReady":false,"releaseReadyMessage":["tests failed"]}`, outcomeFail},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, test.response)
+			}))
+			defer server.Close()
+			savedClient, savedInterval := releaseCheckClient, releasePollInterval
+			defer func() { releaseCheckClient, releasePollInterval = savedClient, savedInterval }()
+			releaseCheckClient, releasePollInterval = server.Client(), 0
+
+			results := make(chan CheckResult, 10)
+			payload := JobPayload{JetId: "jet-1", ArtifactName: "api", ArtifactCreateDate: "2024-05-01T00:00:00Z"}
+			startValidationSteward(context.Background(), server.URL, payload, results)
+			close(results)
+			release := <-results
+			if release.Check != releaseCheck || release.Outcome != test.want {
+				t.Errorf("release check %s %s, want %s: %s", release.Check, release.Outcome, test.want, release.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	jsonReportFormat    = "json"
+	junitReportFormat   = "junit"
+	reportAnnotation    = "policy.opsmx.io/report"
+	maxResponseExcerpt  = 512
+	maxAnnotationReport = 200 * 1024
+	kubeReportTimeout   = 30 * time.Second
+	redactedValue       = "REDACTED"
+)
+
+var reportFile, reportFormat, reportConfigMap string
+var reportToAnnotation bool
+
+// runStartedAt is when the run began, the report covers everything up to the time it is written.
+var runStartedAt = time.Now()
+
+// sensitiveQueryParam matches query parameters that carry credentials and must not end up in a report.
+var sensitiveQueryParam = regexp.MustCompile(`(?i)token|secret|password|passwd|key|auth|signature|credential`)
+
+// ReportDocument is the machine-readable form of a run report.
+type ReportDocument struct {
+	Mode        string         `json:"mode"`
+	Application string         `json:"application,omitempty"`
+	Namespace   string         `json:"namespace,omitempty"`
+	Outcome     string         `json:"outcome"`
+	Error       string         `json:"error,omitempty"`
+	StartedAt   string         `json:"startedAt"`
+	FinishedAt  string         `json:"finishedAt"`
+	DurationMs  int64          `json:"durationMs"`
+	Results     []ReportResult `json:"results"`
+}
+
+type ReportResult struct {
+	Check           string   `json:"check"`
+	Subject         string   `json:"subject"`
+	Outcome         string   `json:"outcome"`
+	Message         string   `json:"message,omitempty"`
+	DurationMs      int64    `json:"durationMs"`
+	Url             string   `json:"url,omitempty"`
+	ResponseExcerpt string   `json:"responseExcerpt,omitempty"`
+	Links           []string `json:"links,omitempty"`
+}
+
+// redactUrl removes the password and credential-like query parameters from rawUrl.
+func redactUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil || rawUrl == "" {
+		return rawUrl
+	}
+	query := u.Query()
+	for name := range query {
+		if sensitiveQueryParam.MatchString(name) {
+			query.Set(name, redactedValue)
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.Redacted()
+}
+
+// redactLinks redacts every link like the check url, links to approval or release pages can
+// carry tokens as well.
+func redactLinks(links []string) []string {
+	if len(links) == 0 {
+		return nil
+	}
+	redacted := make([]string, 0, len(links))
+	for _, link := range links {
+		redacted = append(redacted, redactSecrets(redactUrl(link)))
+	}
+	return redacted
+}
+
+// responseExcerpt shortens a response body for the report.
+func responseExcerpt(response string) string {
+	response = strings.TrimSpace(response)
+	if len(response) > maxResponseExcerpt {
+		return response[:maxResponseExcerpt] + "..."
+	}
+	return response
+}
+
+func newReportDocument(mode string, runErr error) ReportDocument {
+	finished := time.Now()
+	document := ReportDocument{
+		Mode:        mode,
+		Application: argocdAppName,
+		Namespace:   argocdNamespace,
+		Outcome:     outcomePass,
+		StartedAt:   runStartedAt.UTC().Format(time.RFC3339),
+		FinishedAt:  finished.UTC().Format(time.RFC3339),
+		DurationMs:  finished.Sub(runStartedAt).Milliseconds(),
+		Results:     make([]ReportResult, 0),
+	}
+	if runErr != nil {
+		document.Outcome = outcomeFail
+		document.Error = redactSecrets(runErr.Error())
+	}
+	for _, result := range runReport.Results() {
+		document.Results = append(document.Results, ReportResult{
+			Check:           result.Check,
+			Subject:         result.Subject,
+			Outcome:         result.Outcome,
+			Message:         redactSecrets(result.Message),
+			DurationMs:      result.Duration.Milliseconds(),
+			Url:             redactSecrets(redactUrl(result.Url)),
+			ResponseExcerpt: redactSecrets(responseExcerpt(result.Response)),
+			Links:           redactLinks(result.Links),
+		})
+	}
+	return document
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Classname string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// toJUnit renders the report with one test case per result, grouped by check in the classname.
+func (d ReportDocument) toJUnit() ([]byte, error) {
+	suite := junitTestSuite{
+		Name:      "policy-job " + d.Mode,
+		Time:      fmt.Sprintf("%.3f", float64(d.DurationMs)/1000),
+		Timestamp: d.StartedAt,
+	}
+	if d.Application != "" {
+		suite.Name += " " + d.Application
+	}
+	for _, result := range d.Results {
+		testCase := junitTestCase{
+			Classname: "policy-job." + result.Check,
+			Name:      result.Subject,
+			Time:      fmt.Sprintf("%.3f", float64(result.DurationMs)/1000),
+		}
+		switch result.Outcome {
+		case outcomeFail:
+			testCase.Failure = &junitMessage{Message: result.Message, Body: result.Message}
+			suite.Failures++
+		case outcomeError:
+			testCase.Error = &junitMessage{Message: result.Message, Body: result.Message}
+			suite.Errors++
+		case outcomeSkipped:
+			testCase.Skipped = &junitMessage{Message: result.Message}
+			suite.Skipped++
+		}
+		var out []string
+		if result.Outcome == outcomeWarn || result.Outcome == outcomePass {
+			out = append(out, strings.ToUpper(result.Outcome)+": "+result.Message)
+		}
+		if result.Url != "" {
+			out = append(out, "url: "+result.Url)
+		}
+		for _, link := range result.Links {
+			out = append(out, "link: "+link)
+		}
+		if result.ResponseExcerpt != "" {
+			out = append(out, "response: "+result.ResponseExcerpt)
+		}
+		testCase.SystemOut = strings.Join(out, "\n")
+		suite.Cases = append(suite.Cases, testCase)
+		suite.Tests++
+	}
+	content, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), content...), nil
+}
+
+// resolveReportFormat returns --report-format, or guesses it from the report file extension.
+func resolveReportFormat() (string, error) {
+	format := strings.ToLower(strings.TrimSpace(reportFormat))
+	if format == "" {
+		if strings.EqualFold(filepath.Ext(reportFile), ".xml") {
+			return junitReportFormat, nil
+		}
+		return jsonReportFormat, nil
+	}
+	if format != jsonReportFormat && format != junitReportFormat {
+		return "", fmt.Errorf("report-format should either be %s or %s", jsonReportFormat, junitReportFormat)
+	}
+	return format, nil
+}
+
+// writeRunReport writes the report file and stores the report on the cluster as configured.
+// It runs once the command has already passed or failed, so a report that cannot be written
+// only warns.
+func writeRunReport(mode string, runErr error) {
+	if strings.TrimSpace(reportFile) == "" && strings.TrimSpace(reportConfigMap) == "" && !reportToAnnotation {
+		return
+	}
+	document := newReportDocument(mode, runErr)
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(document); err != nil {
+		log.Printf("WARNING: could not render run report: %v", err)
+		return
+	}
+	jsonContent := buffer.Bytes()
+
+	if strings.TrimSpace(reportFile) != "" {
+		if err := writeReportFile(document, jsonContent); err != nil {
+			log.Printf("WARNING: could not write run report %s: %v", reportFile, err)
+		} else {
+			log.Printf("run report written to %s", reportFile)
+		}
+	}
+
+	if strings.TrimSpace(reportConfigMap) == "" && !reportToAnnotation {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), kubeReportTimeout)
+	defer cancel()
+	if err := storeRunReport(ctx, mode, jsonContent); err != nil {
+		log.Printf("WARNING: could not store run report on the cluster: %v", err)
+	}
+}
+
+func writeReportFile(document ReportDocument, jsonContent []byte) error {
+	format, err := resolveReportFormat()
+	if err != nil {
+		return err
+	}
+	content := jsonContent
+	if format == junitReportFormat {
+		if content, err = document.toJUnit(); err != nil {
+			return err
+		}
+	}
+	if dir := filepath.Dir(reportFile); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(reportFile, content, 0o644)
+}
+
+// storeRunReport keeps the json report in --report-configmap under a key per application and mode,
+// and with --report-annotation also as an annotation on the application.
+func storeRunReport(ctx context.Context, mode string, jsonContent []byte) error {
+	if strings.TrimSpace(argocdAppName) == "" {
+		return errors.New("argocd-app-name flag has to be set to store the report on the cluster")
+	}
+	client, err := NewKubeClient()
+	if err != nil {
+		return err
+	}
+	report := string(jsonContent)
+
+	var errs []error
+	if strings.TrimSpace(reportConfigMap) != "" {
+		key := fmt.Sprintf("%s.%s.json", argocdAppName, mode)
+		if err := client.PatchConfigMapData(ctx, argocdNamespace, reportConfigMap, map[string]*string{key: &report}); err != nil {
+			errs = append(errs, fmt.Errorf("configmap %s: %v", reportConfigMap, err))
+		}
+	}
+	if reportToAnnotation {
+		if len(report) > maxAnnotationReport {
+			errs = append(errs, fmt.Errorf("report of %d bytes is too large for an annotation, use report-configmap", len(report)))
+		} else if err := client.PatchApplicationAnnotations(ctx, argocdNamespace, argocdAppName, map[string]*string{reportAnnotation: &report}); err != nil {
+			errs = append(errs, fmt.Errorf("annotation %s: %v", reportAnnotation, err))
+		}
+	}
+	return errors.Join(errs...)
+}
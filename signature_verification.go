@@ -0,0 +1,720 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation      = "dev.sigstore.cosign/bundle"
+	dsseEnvelopeMediaType       = "application/vnd.dsse.envelope.v1+json"
+	inTotoPayloadType           = "application/vnd.in-toto+json"
+	slsaProvenancePrefix        = "https://slsa.dev/provenance/"
+)
+
+var (
+	// oidcIssuerExtension is the Fulcio certificate extension holding the OIDC issuer as a raw string,
+	// oidcIssuerV2Extension holds it DER encoded.
+	oidcIssuerExtension   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	oidcIssuerV2Extension = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+var verifySignatures, requireProvenance bool
+var cosignKeyFiles, cosignIdentities []string
+var cosignRootsFile, rekorPublicKeyFile string
+
+// SignatureVerifier verifies cosign signatures and attestations stored next to an image in its
+// registry, either against public keys or, keyless, against a Fulcio certificate whose identity
+// matches one of the configured rules and whose transparency log entry is signed by Rekor.
+type SignatureVerifier struct {
+	keys          []crypto.PublicKey
+	identities    []IdentityRule
+	roots         *x509.CertPool
+	intermediates *x509.CertPool
+	rekorKey      crypto.PublicKey
+}
+
+// IdentityRule accepts a keyless signing certificate issued for an OIDC issuer to a subject
+// (email or uri) matching the regular expression.
+type IdentityRule struct {
+	Issuer  string
+	Subject *regexp.Regexp
+}
+
+// simpleSigning is the payload cosign signs for an image.
+type simpleSigning struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+type rekorBundle struct {
+	SignedEntryTimestamp string             `json:"SignedEntryTimestamp"`
+	Payload              rekorBundlePayload `json:"Payload"`
+}
+
+// rekorBundlePayload is signed by Rekor in its canonical json form, see canonicalJSON.
+type rekorBundlePayload struct {
+	Body           string `json:"body"`
+	IntegratedTime int64  `json:"integratedTime"`
+	LogIndex       int64  `json:"logIndex"`
+	LogID          string `json:"logID"`
+}
+
+type hashedRekordBody struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Signature struct {
+			Content string `json:"content"`
+		} `json:"signature"`
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+	} `json:"spec"`
+}
+
+type rekorHash struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"value"`
+}
+
+// attestationRekordBody covers the intoto and dsse entries attestations are logged as, intoto keeps
+// its hashes under content.
+type attestationRekordBody struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Content struct {
+			Hash        rekorHash `json:"hash"`
+			PayloadHash rekorHash `json:"payloadHash"`
+		} `json:"content"`
+		EnvelopeHash rekorHash `json:"envelopeHash"`
+		PayloadHash  rekorHash `json:"payloadHash"`
+	} `json:"spec"`
+}
+
+type dsseEnvelope struct {
+	PayloadType string `json:"payloadType"`
+	Payload     string `json:"payload"`
+	Signatures  []struct {
+		Sig string `json:"sig"`
+	} `json:"signatures"`
+}
+
+type inTotoStatement struct {
+	PredicateType string `json:"predicateType"`
+	Subject       []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	Predicate json.RawMessage `json:"predicate"`
+}
+
+// slsaProvenance covers the source fields of both SLSA provenance v0.2 and v1.
+type slsaProvenance struct {
+	Invocation struct {
+		ConfigSource slsaResource `json:"configSource"`
+	} `json:"invocation"`
+	Materials       []slsaResource `json:"materials"`
+	BuildDefinition struct {
+		ResolvedDependencies []slsaResource `json:"resolvedDependencies"`
+	} `json:"buildDefinition"`
+}
+
+type slsaResource struct {
+	Uri    string            `json:"uri"`
+	Digest map[string]string `json:"digest"`
+}
+
+// loadSignatureVerifier builds the verifier from the cosign flags, or returns nil when
+// --verify-signatures is not set.
+func loadSignatureVerifier() (*SignatureVerifier, error) {
+	if !verifySignatures {
+		return nil, nil
+	}
+	verifier := &SignatureVerifier{}
+	for _, file := range cosignKeyFiles {
+		key, err := readPublicKey(file)
+		if err != nil {
+			return nil, err
+		}
+		verifier.keys = append(verifier.keys, key)
+	}
+	for _, spec := range cosignIdentities {
+		rule, err := parseIdentityRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		verifier.identities = append(verifier.identities, rule)
+	}
+	if len(verifier.keys) == 0 && len(verifier.identities) == 0 {
+		return nil, errors.New("either cosign-key or cosign-identity has to be set to verify signatures")
+	}
+	if len(verifier.identities) > 0 {
+		if strings.TrimSpace(cosignRootsFile) == "" || strings.TrimSpace(rekorPublicKeyFile) == "" {
+			return nil, errors.New("cosign-roots and rekor-public-key have to be set for keyless verification with cosign-identity")
+		}
+		content, err := os.ReadFile(cosignRootsFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading cosign roots %s: %v", cosignRootsFile, err)
+		}
+		if verifier.roots, verifier.intermediates, err = parseCertificatePools(content); err != nil {
+			return nil, fmt.Errorf("error parsing cosign roots %s: %v", cosignRootsFile, err)
+		}
+		if verifier.rekorKey, err = readPublicKey(rekorPublicKeyFile); err != nil {
+			return nil, err
+		}
+	}
+	return verifier, nil
+}
+
+// parseIdentityRule reads a --cosign-identity rule of the form issuer=<url>,subject=<regexp>.
+func parseIdentityRule(spec string) (IdentityRule, error) {
+	var rule IdentityRule
+	for _, part := range strings.Split(spec, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "issuer":
+			rule.Issuer = value
+		case "subject":
+			subject, err := regexp.Compile(value)
+			if err != nil {
+				return IdentityRule{}, fmt.Errorf("invalid subject in cosign-identity %q: %v", spec, err)
+			}
+			rule.Subject = subject
+		default:
+			return IdentityRule{}, fmt.Errorf("unknown key %q in cosign-identity %q, should be issuer or subject", key, spec)
+		}
+	}
+	if rule.Issuer == "" || rule.Subject == nil {
+		return IdentityRule{}, fmt.Errorf("cosign-identity %q has to set both issuer and subject", spec)
+	}
+	return rule, nil
+}
+
+func readPublicKey(file string) (crypto.PublicKey, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading public key %s: %v", file, err)
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("public key %s is not PEM encoded", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing public key %s: %v", file, err)
+	}
+	return key, nil
+}
+
+// parseCertificatePools splits a PEM bundle into self-signed roots and intermediates.
+func parseCertificatePools(content []byte) (*x509.CertPool, *x509.CertPool, error) {
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	found := false
+	for block, rest := pem.Decode(content); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		if cert.CheckSignatureFrom(cert) == nil {
+			roots.AddCert(cert)
+			found = true
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	if !found {
+		return nil, nil, errors.New("no root certificate found")
+	}
+	return roots, intermediates, nil
+}
+
+// VerifySignature checks that a signature of image, which has to carry its digest, verifies.
+func (v *SignatureVerifier) VerifySignature(ctx context.Context, registry *RegistryClient, image ImageReference) (string, error) {
+	manifest, _, err := registry.getManifest(ctx, image, cosignTag(image.Digest, "sig"))
+	if errors.Is(err, ErrNotFound) {
+		return "", errors.New("image is not signed")
+	} else if err != nil {
+		return "", err
+	}
+	reasons := make([]string, 0)
+	for _, layer := range manifest.Layers {
+		payload, err := registry.getBlob(ctx, image, layer.Digest)
+		if err != nil {
+			reasons = append(reasons, err.Error())
+			continue
+		}
+		var signed simpleSigning
+		if err := json.Unmarshal(payload, &signed); err != nil {
+			reasons = append(reasons, fmt.Sprintf("invalid signature payload: %v", err))
+			continue
+		}
+		if signed.Critical.Image.DockerManifestDigest != image.Digest {
+			reasons = append(reasons, fmt.Sprintf("signature is for digest %s", signed.Critical.Image.DockerManifestDigest))
+			continue
+		}
+		signature, err := base64.StdEncoding.DecodeString(layer.Annotations[cosignSignatureAnnotation])
+		if err != nil || len(signature) == 0 {
+			reasons = append(reasons, "signature annotation is missing or invalid")
+			continue
+		}
+		signer, err := v.verify(layer.Annotations, payload, signature, func(bundle rekorBundle) error {
+			return matchHashedRekord(bundle, payload, signature)
+		})
+		if err != nil {
+			reasons = append(reasons, err.Error())
+			continue
+		}
+		return signer, nil
+	}
+	return "", fmt.Errorf("no valid signature: %s", strings.Join(dedup(reasons), "; "))
+}
+
+// VerifyProvenance checks that a signed SLSA provenance attestation of image names the given source
+// repository and commit.
+func (v *SignatureVerifier) VerifyProvenance(ctx context.Context, registry *RegistryClient, image ImageReference, repository, commit string) (string, error) {
+	manifest, _, err := registry.getManifest(ctx, image, cosignTag(image.Digest, "att"))
+	if errors.Is(err, ErrNotFound) {
+		return "", errors.New("image has no attestations")
+	} else if err != nil {
+		return "", err
+	}
+	reasons := make([]string, 0)
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != dsseEnvelopeMediaType {
+			continue
+		}
+		content, err := registry.getBlob(ctx, image, layer.Digest)
+		if err != nil {
+			reasons = append(reasons, err.Error())
+			continue
+		}
+		var envelope dsseEnvelope
+		if err := json.Unmarshal(content, &envelope); err != nil || envelope.PayloadType != inTotoPayloadType {
+			reasons = append(reasons, "attestation is not an in-toto envelope")
+			continue
+		}
+		payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+		if err != nil {
+			reasons = append(reasons, "attestation payload is not base64 encoded")
+			continue
+		}
+		var statement inTotoStatement
+		if err := json.Unmarshal(payload, &statement); err != nil {
+			reasons = append(reasons, fmt.Sprintf("invalid attestation statement: %v", err))
+			continue
+		}
+		if !strings.HasPrefix(statement.PredicateType, slsaProvenancePrefix) {
+			continue
+		}
+		if !statementHasSubject(statement, image.Digest) {
+			reasons = append(reasons, fmt.Sprintf("provenance is not for digest %s", image.Digest))
+			continue
+		}
+
+		var signer string
+		err = errors.New("attestation is not signed")
+		for _, signature := range envelope.Signatures {
+			decoded, decodeErr := base64.StdEncoding.DecodeString(signature.Sig)
+			if decodeErr != nil {
+				continue
+			}
+			matchEntry := func(bundle rekorBundle) error {
+				return matchAttestationRekord(bundle, content, payload)
+			}
+			if signer, err = v.verify(layer.Annotations, dssePAE(envelope.PayloadType, payload), decoded, matchEntry); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			reasons = append(reasons, err.Error())
+			continue
+		}
+
+		var provenance slsaProvenance
+		if err := json.Unmarshal(statement.Predicate, &provenance); err != nil {
+			reasons = append(reasons, fmt.Sprintf("invalid provenance predicate: %v", err))
+			continue
+		}
+		if err := matchProvenanceSource(provenance, repository, commit); err != nil {
+			reasons = append(reasons, err.Error())
+			continue
+		}
+		return signer, nil
+	}
+	if len(reasons) == 0 {
+		return "", errors.New("image has no SLSA provenance attestation")
+	}
+	return "", fmt.Errorf("no valid provenance: %s", strings.Join(dedup(reasons), "; "))
+}
+
+// verify checks signature over signed with a configured key, or keyless with the certificate in
+// the annotations, where matchEntry checks that the logged entry is the one of this signature.
+// It returns who signed.
+func (v *SignatureVerifier) verify(annotations map[string]string, signed, signature []byte, matchEntry func(rekorBundle) error) (string, error) {
+	for _, key := range v.keys {
+		if verifySignature(key, signed, signature) == nil {
+			return "public key", nil
+		}
+	}
+	if len(v.identities) == 0 || annotations[cosignCertificateAnnotation] == "" {
+		if len(v.keys) > 0 {
+			return "", errors.New("signature does not verify with any cosign-key")
+		}
+		return "", errors.New("signature has no certificate for keyless verification")
+	}
+
+	cert, bundle, err := v.verifyCertificate(annotations)
+	if err != nil {
+		return "", err
+	}
+	if err := verifySignature(cert.PublicKey, signed, signature); err != nil {
+		return "", fmt.Errorf("signature does not verify with its certificate: %v", err)
+	}
+	if err := matchEntry(bundle); err != nil {
+		return "", err
+	}
+	return strings.Join(certificateSubjects(cert), ","), nil
+}
+
+// verifyCertificate checks the signing certificate against the roots at the time Rekor logged it,
+// the Rekor signature over the log entry and the certificate identity.
+func (v *SignatureVerifier) verifyCertificate(annotations map[string]string) (*x509.Certificate, rekorBundle, error) {
+	block, _ := pem.Decode([]byte(annotations[cosignCertificateAnnotation]))
+	if block == nil {
+		return nil, rekorBundle{}, errors.New("signing certificate is not PEM encoded")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, rekorBundle{}, fmt.Errorf("error parsing signing certificate: %v", err)
+	}
+
+	var bundle rekorBundle
+	if err := json.Unmarshal([]byte(annotations[cosignBundleAnnotation]), &bundle); err != nil {
+		return nil, rekorBundle{}, errors.New("signature has no transparency log bundle")
+	}
+	if err := v.verifyBundle(bundle); err != nil {
+		return nil, rekorBundle{}, err
+	}
+
+	intermediates := v.intermediates.Clone()
+	for chainBlock, rest := pem.Decode([]byte(annotations[cosignChainAnnotation])); chainBlock != nil; chainBlock, rest = pem.Decode(rest) {
+		if chainCert, err := x509.ParseCertificate(chainBlock.Bytes); err == nil {
+			intermediates.AddCert(chainCert)
+		}
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		CurrentTime:   time.Unix(bundle.Payload.IntegratedTime, 0),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	})
+	if err != nil {
+		return nil, rekorBundle{}, fmt.Errorf("signing certificate does not verify: %v", err)
+	}
+
+	issuer := certificateIssuer(cert)
+	subjects := certificateSubjects(cert)
+	for _, rule := range v.identities {
+		if rule.Issuer != issuer {
+			continue
+		}
+		for _, subject := range subjects {
+			if rule.Subject.MatchString(subject) {
+				return cert, bundle, nil
+			}
+		}
+	}
+	return nil, rekorBundle{}, fmt.Errorf("certificate identity %s from issuer %s does not match any cosign-identity", strings.Join(subjects, ","), issuer)
+}
+
+func (v *SignatureVerifier) verifyBundle(bundle rekorBundle) error {
+	signature, err := base64.StdEncoding.DecodeString(bundle.SignedEntryTimestamp)
+	if err != nil || len(signature) == 0 {
+		return errors.New("transparency log bundle has no signed entry timestamp")
+	}
+	canonical, err := canonicalJSON(bundle.Payload)
+	if err != nil {
+		return err
+	}
+	if err := verifySignature(v.rekorKey, canonical, signature); err != nil {
+		return fmt.Errorf("transparency log entry is not signed by rekor-public-key: %v", err)
+	}
+	return nil
+}
+
+// canonicalJSON encodes v with sorted keys and without html escaping, the form Rekor signs its
+// entries in. Marshalling through a map sorts the keys, the numbers are kept as they are.
+func canonicalJSON(v interface{}) ([]byte, error) {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(generic); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// matchAttestationRekord checks that the transparency log entry is the one of this attestation, by
+// the hash of the envelope or, for entries that only carry it, the hash of its payload.
+func matchAttestationRekord(bundle rekorBundle, envelope, payload []byte) error {
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return errors.New("transparency log entry body is not base64 encoded")
+	}
+	var entry attestationRekordBody
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return fmt.Errorf("invalid transparency log entry: %v", err)
+	}
+	if entry.Kind != "intoto" && entry.Kind != "dsse" {
+		return fmt.Errorf("transparency log entry of kind %q is not an attestation", entry.Kind)
+	}
+	envelopeHash := firstNonEmpty(entry.Spec.Content.Hash.Value, entry.Spec.EnvelopeHash.Value)
+	payloadHash := firstNonEmpty(entry.Spec.Content.PayloadHash.Value, entry.Spec.PayloadHash.Value)
+	envelopeSum := sha256.Sum256(envelope)
+	payloadSum := sha256.Sum256(payload)
+	switch {
+	case envelopeHash != "":
+		if envelopeHash != hex.EncodeToString(envelopeSum[:]) {
+			return errors.New("transparency log entry does not match the attestation envelope")
+		}
+	case payloadHash != "":
+		if payloadHash != hex.EncodeToString(payloadSum[:]) {
+			return errors.New("transparency log entry does not match the attestation payload")
+		}
+	default:
+		return errors.New("transparency log entry has no attestation hash")
+	}
+	return nil
+}
+
+// matchHashedRekord checks that the transparency log entry is the one of this signature.
+func matchHashedRekord(bundle rekorBundle, signed, signature []byte) error {
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return errors.New("transparency log entry body is not base64 encoded")
+	}
+	var entry hashedRekordBody
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return fmt.Errorf("invalid transparency log entry: %v", err)
+	}
+	sum := sha256.Sum256(signed)
+	if entry.Spec.Data.Hash.Value != hex.EncodeToString(sum[:]) || entry.Spec.Signature.Content != base64.StdEncoding.EncodeToString(signature) {
+		return errors.New("transparency log entry does not match the signature")
+	}
+	return nil
+}
+
+func verifySignature(key crypto.PublicKey, signed, signature []byte) error {
+	digest := sha256.Sum256(signed)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest[:], signature) {
+			return errors.New("invalid ecdsa signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, signed, signature) {
+			return errors.New("invalid ed25519 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key type %T", key)
+}
+
+func certificateIssuer(cert *x509.Certificate) string {
+	for _, extension := range cert.Extensions {
+		if extension.Id.Equal(oidcIssuerV2Extension) {
+			var issuer string
+			if _, err := asn1.Unmarshal(extension.Value, &issuer); err == nil {
+				return issuer
+			}
+		}
+	}
+	for _, extension := range cert.Extensions {
+		if extension.Id.Equal(oidcIssuerExtension) {
+			return string(extension.Value)
+		}
+	}
+	return ""
+}
+
+func certificateSubjects(cert *x509.Certificate) []string {
+	subjects := append([]string{}, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		subjects = append(subjects, uri.String())
+	}
+	return subjects
+}
+
+// cosignTag is the tag cosign stores signatures (sig) and attestations (att) of a digest under.
+func cosignTag(digest, suffix string) string {
+	return strings.Replace(digest, ":", "-", 1) + "." + suffix
+}
+
+// dssePAE is the DSSE pre-authentication encoding the envelope signatures are made over.
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+func statementHasSubject(statement inTotoStatement, digest string) bool {
+	algorithm, value, _ := strings.Cut(digest, ":")
+	for _, subject := range statement.Subject {
+		if subject.Digest[algorithm] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// matchProvenanceSource requires a source of the provenance to be repository at commit, both have
+// to be known. Sources are uris like git+https://github.com/org/repo@refs/heads/main with a sha1 or
+// gitCommit digest.
+func matchProvenanceSource(provenance slsaProvenance, repository, commit string) error {
+	if missing := missingProvenanceSource(repository, commit); missing != "" {
+		return fmt.Errorf("%s is not set to match the provenance against", missing)
+	}
+	sources := append([]slsaResource{provenance.Invocation.ConfigSource}, provenance.Materials...)
+	sources = append(sources, provenance.BuildDefinition.ResolvedDependencies...)
+	seen := make([]string, 0)
+	for _, source := range sources {
+		if source.Uri == "" {
+			continue
+		}
+		uri := strings.TrimPrefix(source.Uri, "git+")
+		if ix := strings.LastIndex(uri, "@"); ix > strings.Index(uri, "://")+2 {
+			uri = uri[:ix]
+		}
+		sourceCommit := firstNonEmpty(source.Digest["gitCommit"], source.Digest["sha1"])
+		seen = append(seen, fmt.Sprintf("%s@%s", uri, sourceCommit))
+		if normalizeRepoUrl(uri) == normalizeRepoUrl(repository) && strings.EqualFold(sourceCommit, commit) {
+			return nil
+		}
+	}
+	return fmt.Errorf("provenance source %s does not match %s@%s", strings.Join(seen, ", "), repository, commit)
+}
+
+// missingProvenanceSource names what is missing of the repository and commit a provenance is matched against.
+func missingProvenanceSource(repository, commit string) string {
+	switch {
+	case repository == "" && commit == "":
+		return "repo-url and git-last-commitId"
+	case repository == "":
+		return "repo-url"
+	case commit == "":
+		return "git-last-commitId"
+	}
+	return ""
+}
+
+func dedup(values []string) []string {
+	seen := make(map[string]bool)
+	unique := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
+
+// checkSignatures verifies the signature, and with --require-provenance the provenance, of every
+// payload image, one result per image and check. The digest verified is the one deployed, taken from
+// the image reference or resolved from its tag, and an artifact id naming another digest fails.
+func checkSignatures(ctx context.Context, verifier *SignatureVerifier, jobPayloads []JobPayload) []CheckResult {
+	results := make([]CheckResult, 0, len(jobPayloads))
+	registry, err := NewRegistryClient(registryClient)
+	if err != nil {
+		return append(results, CheckResult{Check: signatureCheck, Subject: "-", Outcome: outcomeError, Message: err.Error()})
+	}
+	for _, payload := range jobPayloads {
+		subject := payloadSubject(payload)
+		started := time.Now()
+		image, err := payloadImageReference(payload)
+		if err == nil && image.Digest == "" {
+			var resolved ResolvedImage
+			if resolved, err = registry.Resolve(ctx, image); err == nil {
+				image.Digest = resolved.Digest
+			}
+		}
+		if err != nil {
+			log.Printf("ERROR: While resolving Image: %s for signature verification - err: %v", payload.ArtifactName, err)
+			results = append(results, CheckResult{Check: signatureCheck, Subject: subject, Outcome: outcomeError, Message: err.Error(), Duration: time.Since(started)})
+			continue
+		}
+		if strings.HasPrefix(payload.ArtifactId, "sha256:") && payload.ArtifactId != image.Digest {
+			message := fmt.Sprintf("artifactId %s is not the deployed digest %s", payload.ArtifactId, image.Digest)
+			log.Printf("FAILURE: %s verification failed for Image: %s - %s", signatureCheck, image, message)
+			results = append(results, CheckResult{Check: signatureCheck, Subject: subject, Outcome: outcomeFail, Message: message, Duration: time.Since(started)})
+			continue
+		}
+
+		results = append(results, signatureResult(signatureCheck, subject, image, started, func() (string, error) {
+			return verifier.VerifySignature(ctx, registry, image)
+		}))
+		if requireProvenance {
+			started = time.Now()
+			repository := firstNonEmpty(payload.RepoUrl, repoUrl)
+			commit := firstNonEmpty(payload.CommitId, gitLastCommitId)
+			results = append(results, signatureResult(provenanceCheck, subject, image, started, func() (string, error) {
+				return verifier.VerifyProvenance(ctx, registry, image, repository, commit)
+			}))
+		}
+	}
+	return results
+}
+
+func signatureResult(check, subject string, image ImageReference, started time.Time, verify func() (string, error)) CheckResult {
+	result := CheckResult{Check: check, Subject: subject}
+	if signer, err := verify(); err != nil {
+		log.Printf("FAILURE: %s verification failed for Image: %s - %v", check, image, err)
+		result.Outcome = outcomeFail
+		result.Message = err.Error()
+	} else {
+		log.Printf("SUCCESS: %s verification passed for Image: %s", check, image)
+		result.Outcome = outcomePass
+		result.Message = fmt.Sprintf("%s verified, signed by %s", image.Digest, signer)
+	}
+	result.Duration = time.Since(started)
+	return result
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer  = "https://accounts.example.com"
+	testSubject = "release@example.com"
+)
+
+// signedAt is when the fixtures were logged, inside the ten minutes the signing certificate is valid.
+var signedAt = time.Date(2024, 5, 1, 10, 5, 0, 0, time.UTC)
+
+// cosignFixture is a Fulcio-like root that issues signing certificates and a Rekor key that signs
+// log entries, generated for each test.
+type cosignFixture struct {
+	rootKey  *ecdsa.PrivateKey
+	root     *x509.Certificate
+	rekorKey *ecdsa.PrivateKey
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testSign(t *testing.T, key *ecdsa.PrivateKey, content []byte) []byte {
+	t.Helper()
+	digest := sha256.Sum256(content)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signature
+}
+
+func newCosignFixture(t *testing.T) *cosignFixture {
+	t.Helper()
+	fixture := &cosignFixture{rootKey: newTestKey(t), rekorKey: newTestKey(t)}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-fulcio-root"},
+		NotBefore:             time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:              time.Date(2034, 1, 1, 0, 0, 0, 0, time.UTC),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &fixture.rootKey.PublicKey, fixture.rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixture.root, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	return fixture
+}
+
+// certificate issues a ten minute signing certificate for subject from issuer, carried in the v2
+// extension, and returns its key and PEM.
+func (f *cosignFixture) certificate(t *testing.T, subject, issuer string) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key := newTestKey(t)
+	issuerValue, err := asn1.Marshal(issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       signedAt.Add(-5 * time.Minute),
+		NotAfter:        signedAt.Add(5 * time.Minute),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses:  []string{subject},
+		ExtraExtensions: []pkix.Extension{{Id: oidcIssuerV2Extension, Value: issuerValue}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, f.root, &key.PublicKey, f.rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// bundle logs body at integratedTime and returns the bundle signed by the Rekor key.
+func (f *cosignFixture) bundle(t *testing.T, body string, integratedTime time.Time) rekorBundle {
+	t.Helper()
+	payload := rekorBundlePayload{
+		Body:           base64.StdEncoding.EncodeToString([]byte(body)),
+		IntegratedTime: integratedTime.Unix(),
+		LogIndex:       4711,
+		LogID:          "c0d23d6ad406973f9559f3ba2d1ca01f84147d8ffc5b8445c224f98b9591801d",
+	}
+	canonical, err := canonicalJSON(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := base64.StdEncoding.EncodeToString(testSign(t, f.rekorKey, canonical))
+	return rekorBundle{SignedEntryTimestamp: signature, Payload: payload}
+}
+
+func (f *cosignFixture) verifier(t *testing.T, identities ...string) *SignatureVerifier {
+	t.Helper()
+	verifier := &SignatureVerifier{roots: x509.NewCertPool(), intermediates: x509.NewCertPool(), rekorKey: &f.rekorKey.PublicKey}
+	verifier.roots.AddCert(f.root)
+	for _, spec := range identities {
+		rule, err := parseIdentityRule(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifier.identities = append(verifier.identities, rule)
+	}
+	return verifier
+}
+
+func hashedRekord(signed, signature []byte) string {
+	sum := sha256.Sum256(signed)
+	return fmt.Sprintf(`{"apiVersion":"0.0.1","kind":"hashedrekord","spec":{"data":{"hash":{"algorithm":"sha256","value":%q}},"signature":{"content":%q}}}`,
+		hex.EncodeToString(sum[:]), base64.StdEncoding.EncodeToString(signature))
+}
+
+// keylessAnnotations signs signed with a fresh certificate for subject and logs the signature.
+func (f *cosignFixture) keylessAnnotations(t *testing.T, subject, issuer string, signed []byte) (map[string]string, []byte) {
+	t.Helper()
+	key, certificate := f.certificate(t, subject, issuer)
+	signature := testSign(t, key, signed)
+	bundle, err := json.Marshal(f.bundle(t, hashedRekord(signed, signature), signedAt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]string{
+		cosignSignatureAnnotation:   base64.StdEncoding.EncodeToString(signature),
+		cosignCertificateAnnotation: certificate,
+		cosignBundleAnnotation:      string(bundle),
+	}, signature
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	canonical, err := canonicalJSON(rekorBundlePayload{Body: "<a&b>", IntegratedTime: 1714557900, LogIndex: 9007199254740993, LogID: "log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"body":"<a&b>","integratedTime":1714557900,"logID":"log","logIndex":9007199254740993}`
+	if string(canonical) != want {
+		t.Errorf("canonicalJSON = %s, want %s", canonical, want)
+	}
+
+	canonical, err = canonicalJSON(map[string]interface{}{"b": []int{2, 1}, "a": map[string]string{"y": "1", "x": "2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"a":{"x":"2","y":"1"},"b":[2,1]}`; string(canonical) != want {
+		t.Errorf("canonicalJSON = %s, want %s", canonical, want)
+	}
+}
+
+func TestVerifyBundle(t *testing.T) {
+	fixture := newCosignFixture(t)
+	verifier := fixture.verifier(t)
+	valid := fixture.bundle(t, `{"kind":"hashedrekord"}`, signedAt)
+	if err := verifier.verifyBundle(valid); err != nil {
+		t.Fatalf("valid bundle: %v", err)
+	}
+
+	tamperedBody := valid
+	tamperedBody.Payload.Body = base64.StdEncoding.EncodeToString([]byte(`{"kind":"intoto"}`))
+	tamperedTime := valid
+	tamperedTime.Payload.IntegratedTime++
+	otherKey := fixture.verifier(t)
+	otherKey.rekorKey = &newTestKey(t).PublicKey
+	missing := valid
+	missing.SignedEntryTimestamp = ""
+	for name, test := range map[string]struct {
+		verifier *SignatureVerifier
+		bundle   rekorBundle
+		want     string
+	}{
+		"tampered body":     {verifier, tamperedBody, "not signed by rekor-public-key"},
+		"tampered time":     {verifier, tamperedTime, "not signed by rekor-public-key"},
+		"other rekor key":   {otherKey, valid, "not signed by rekor-public-key"},
+		"missing timestamp": {verifier, missing, "no signed entry timestamp"},
+	} {
+		if err := test.verifier.verifyBundle(test.bundle); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error containing %q", name, err, test.want)
+		}
+	}
+}
+
+func TestMatchHashedRekord(t *testing.T) {
+	signed, signature := []byte(`{"critical":{}}`), []byte("signature")
+	bundle := func(body string) rekorBundle {
+		return rekorBundle{Payload: rekorBundlePayload{Body: base64.StdEncoding.EncodeToString([]byte(body))}}
+	}
+	if err := matchHashedRekord(bundle(hashedRekord(signed, signature)), signed, signature); err != nil {
+		t.Errorf("matching entry: %v", err)
+	}
+	for name, entry := range map[string]rekorBundle{
+		"other payload":   bundle(hashedRekord([]byte(`{"critical":{"other":1}}`), signature)),
+		"other signature": bundle(hashedRekord(signed, []byte("other signature"))),
+		"invalid body":    {Payload: rekorBundlePayload{Body: "not base64!"}},
+	} {
+		if err := matchHashedRekord(entry, signed, signature); err == nil {
+			t.Errorf("%s: entry matched", name)
+		}
+	}
+}
+
+func TestMatchAttestationRekord(t *testing.T) {
+	envelope, payload := []byte(`{"payloadType":"application/vnd.in-toto+json"}`), []byte(`{"_type":"statement"}`)
+	hash := func(content []byte) string {
+		sum := sha256.Sum256(content)
+		return hex.EncodeToString(sum[:])
+	}
+	for _, test := range []struct {
+		name string
+		body string
+		want string
+	}{
+		{"intoto envelope hash", fmt.Sprintf(`{"kind":"intoto","spec":{"content":{"hash":{"algorithm":"sha256","value":%q}}}}`, hash(envelope)), ""},
+		{"intoto payload hash only", fmt.Sprintf(`{"kind":"intoto","spec":{"content":{"payloadHash":{"algorithm":"sha256","value":%q}}}}`, hash(payload)), ""},
+		{"dsse envelope hash", fmt.Sprintf(`{"kind":"dsse","spec":{"envelopeHash":{"algorithm":"sha256","value":%q},"payloadHash":{"value":"ignored"}}}`, hash(envelope)), ""},
+		{"dsse payload hash only", fmt.Sprintf(`{"kind":"dsse","spec":{"payloadHash":{"algorithm":"sha256","value":%q}}}`, hash(payload)), ""},
+		{"envelope mismatch", fmt.Sprintf(`{"kind":"intoto","spec":{"content":{"hash":{"value":%q},"payloadHash":{"value":%q}}}}`, hash(payload), hash(payload)), "does not match the attestation envelope"},
+		{"payload mismatch", fmt.Sprintf(`{"kind":"dsse","spec":{"payloadHash":{"value":%q}}}`, hash(envelope)), "does not match the attestation payload"},
+		{"no hash", `{"kind":"dsse","spec":{}}`, "has no attestation hash"},
+		{"signature entry", hashedRekord(payload, []byte("signature")), `kind "hashedrekord" is not an attestation`},
+	} {
+		bundle := rekorBundle{Payload: rekorBundlePayload{Body: base64.StdEncoding.EncodeToString([]byte(test.body))}}
+		err := matchAttestationRekord(bundle, envelope, payload)
+		if test.want == "" && err != nil || test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestCertificateIssuer(t *testing.T) {
+	v2, err := asn1.Marshal("https://token.actions.githubusercontent.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, test := range map[string]struct {
+		extensions []pkix.Extension
+		want       string
+	}{
+		"v2 extension": {[]pkix.Extension{{Id: oidcIssuerV2Extension, Value: v2}}, "https://token.actions.githubusercontent.com"},
+		"v1 extension": {[]pkix.Extension{{Id: oidcIssuerExtension, Value: []byte("https://accounts.google.com")}}, "https://accounts.google.com"},
+		"v2 wins over v1": {[]pkix.Extension{
+			{Id: oidcIssuerExtension, Value: []byte("https://accounts.google.com")},
+			{Id: oidcIssuerV2Extension, Value: v2},
+		}, "https://token.actions.githubusercontent.com"},
+		"no extension": {nil, ""},
+	} {
+		if got := certificateIssuer(&x509.Certificate{Extensions: test.extensions}); got != test.want {
+			t.Errorf("%s: certificateIssuer = %q, want %q", name, got, test.want)
+		}
+	}
+}
+
+func TestVerifyKeyless(t *testing.T) {
+	fixture := newCosignFixture(t)
+	signed := []byte(`{"critical":{"image":{"docker-manifest-digest":"sha256:abc"}}}`)
+	matchEntry := func(signature []byte) func(rekorBundle) error {
+		return func(bundle rekorBundle) error { return matchHashedRekord(bundle, signed, signature) }
+	}
+	rule := fmt.Sprintf(`issuer=%s,subject=^release@example\.com$`, testIssuer)
+
+	annotations, signature := fixture.keylessAnnotations(t, testSubject, testIssuer, signed)
+	signer, err := fixture.verifier(t, "issuer=https://other.example.com,subject=.*", rule).verify(annotations, signed, signature, matchEntry(signature))
+	if err != nil || signer != testSubject {
+		t.Fatalf("verify = %q, %v, want %s", signer, err, testSubject)
+	}
+
+	wrongSubject, wrongSubjectSignature := fixture.keylessAnnotations(t, "intruder@example.com", testIssuer, signed)
+	wrongIssuer, wrongIssuerSignature := fixture.keylessAnnotations(t, testSubject, "https://evil.example.com", signed)
+	expired, expiredSignature := fixture.keylessAnnotations(t, testSubject, testIssuer, signed)
+	late, err := json.Marshal(fixture.bundle(t, hashedRekord(signed, expiredSignature), signedAt.Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired[cosignBundleAnnotation] = string(late)
+	otherRoot := newCosignFixture(t)
+	untrusted, untrustedSignature := otherRoot.keylessAnnotations(t, testSubject, testIssuer, signed)
+	untrusted[cosignBundleAnnotation] = annotations[cosignBundleAnnotation]
+
+	for _, test := range []struct {
+		name        string
+		annotations map[string]string
+		signature   []byte
+		matched     []byte
+		want        string
+	}{
+		{"wrong subject", wrongSubject, wrongSubjectSignature, wrongSubjectSignature, "identity intruder@example.com from issuer https://accounts.example.com does not match"},
+		{"wrong issuer", wrongIssuer, wrongIssuerSignature, wrongIssuerSignature, "from issuer https://evil.example.com does not match"},
+		{"certificate expired when logged", expired, expiredSignature, expiredSignature, "signing certificate does not verify"},
+		{"untrusted root", untrusted, untrustedSignature, untrustedSignature, "signing certificate does not verify"},
+		{"signature of another certificate", annotations, wrongSubjectSignature, wrongSubjectSignature, "does not verify with its certificate"},
+		{"log entry of another signature", annotations, signature, wrongSubjectSignature, "does not match the signature"},
+	} {
+		_, err := fixture.verifier(t, rule).verify(test.annotations, signed, test.signature, matchEntry(test.matched))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got %v, want an error containing %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestMatchProvenanceSource(t *testing.T) {
+	var v02, v1 slsaProvenance
+	if err := json.Unmarshal([]byte(`{"invocation":{"configSource":{"uri":"git+https://github.com/Team/Payments@refs/heads/main","digest":{"sha1":"abc1234"}}}}`), &v02); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(`{"buildDefinition":{"resolvedDependencies":[
+		{"uri":"git+https://github.com/team/tooling@refs/heads/main","digest":{"gitCommit":"abc1234"}},
+		{"uri":"git+https://github.com/team/payments.git","digest":{"gitCommit":"def5678"}}]}}`), &v1); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name       string
+		provenance slsaProvenance
+		repository string
+		commit     string
+		want       string
+	}{
+		{"v0.2 config source", v02, "https://github.com/team/payments.git", "ABC1234", ""},
+		{"v1 resolved dependency", v1, "https://github.com/Team/Payments", "def5678", ""},
+		{"commit of another repository", v1, "https://github.com/team/payments", "abc1234", "does not match https://github.com/team/payments@abc1234"},
+		{"other commit", v02, "https://github.com/team/payments", "def5678", "does not match"},
+		{"other repository", v02, "https://github.com/team/cart", "abc1234", "does not match"},
+		{"only the repository", v02, "https://github.com/team/payments", "", "git-last-commitId is not set"},
+		{"only the commit", v02, "", "abc1234", "repo-url is not set"},
+		{"neither", v02, "", "", "repo-url and git-last-commitId is not set"},
+	} {
+		err := matchProvenanceSource(test.provenance, test.repository, test.commit)
+		if test.want == "" && err != nil || test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+// signatureRegistry serves the image team/app:1.0 and the cosign signature manifest of its digest
+// with the layers set by the test.
+type signatureRegistry struct {
+	server *httptest.Server
+	digest string
+	blobs  map[string]string
+	layers []registryDescriptor
+}
+
+func newSignatureRegistry(t *testing.T) *signatureRegistry {
+	t.Helper()
+	const config = `{"created":"2024-05-01T10:00:00Z"}`
+	manifest := fmt.Sprintf(`{"mediaType":%q,"config":{"digest":%q}}`, ociImageManifest, sha256Digest(config))
+	registry := &signatureRegistry{digest: sha256Digest(manifest), blobs: map[string]string{sha256Digest(config): config}}
+	registry.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path := strings.TrimPrefix(r.URL.Path, "/v2/team/app"); {
+		case path == "/manifests/1.0" || path == "/manifests/"+registry.digest:
+			fmt.Fprint(w, manifest)
+		case path == "/manifests/"+cosignTag(registry.digest, "sig") && registry.layers != nil:
+			if err := json.NewEncoder(w).Encode(registryManifest{MediaType: ociImageManifest, Layers: registry.layers}); err != nil {
+				t.Error(err)
+			}
+		case strings.HasPrefix(path, "/blobs/") && registry.blobs[strings.TrimPrefix(path, "/blobs/")] != "":
+			fmt.Fprint(w, registry.blobs[strings.TrimPrefix(path, "/blobs/")])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(registry.server.Close)
+
+	savedClient, savedPath, savedInsecure := registryClient, dockerConfigPath, insecureRegistries
+	t.Cleanup(func() { registryClient, dockerConfigPath, insecureRegistries = savedClient, savedPath, savedInsecure })
+	registryClient = registry.server.Client()
+	dockerConfigPath = filepath.Join(t.TempDir(), "missing.json")
+	insecureRegistries = []string{registry.host()}
+	return registry
+}
+
+func (r *signatureRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+// sign serves a single signature layer for payload with the given annotations.
+func (r *signatureRegistry) sign(payload string, annotations map[string]string) {
+	r.blobs[sha256Digest(payload)] = payload
+	r.layers = []registryDescriptor{{MediaType: "application/vnd.dev.cosign.simplesigning.v1+json", Digest: sha256Digest(payload), Annotations: annotations}}
+}
+
+func simpleSigningPayload(host, digest string) string {
+	return fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"%s/team/app"},"image":{"docker-manifest-digest":%q},"type":"cosign container image signature"},"optional":null}`, host, digest)
+}
+
+func TestCheckSignatures(t *testing.T) {
+	fixture := newCosignFixture(t)
+	registry := newSignatureRegistry(t)
+	key := newTestKey(t)
+	keyVerifier := &SignatureVerifier{keys: []crypto.PublicKey{&key.PublicKey}}
+	keylessVerifier := fixture.verifier(t, fmt.Sprintf(`issuer=%s,subject=^release@example\.com$`, testIssuer))
+	payload := simpleSigningPayload(registry.host(), registry.digest)
+	keySigned := func(payload string) map[string]string {
+		return map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(testSign(t, key, []byte(payload)))}
+	}
+	keyless := func(subject string) map[string]string {
+		annotations, _ := fixture.keylessAnnotations(t, subject, testIssuer, []byte(payload))
+		return annotations
+	}
+	otherDigest := sha256Digest("other manifest")
+
+	for _, test := range []struct {
+		name        string
+		verifier    *SignatureVerifier
+		artifactId  string
+		payload     string
+		annotations map[string]string
+		unsigned    bool
+		outcome     string
+		message     string
+	}{
+		{name: "signed with the key", verifier: keyVerifier, payload: payload, annotations: keySigned(payload), outcome: outcomePass, message: "signed by public key"},
+		{name: "artifact id of the deployed digest", verifier: keyVerifier, artifactId: registry.digest, payload: payload, annotations: keySigned(payload), outcome: outcomePass, message: "verified"},
+		{name: "artifact id of another digest", verifier: keyVerifier, artifactId: otherDigest, payload: payload, annotations: keySigned(payload), outcome: outcomeFail, message: "artifactId " + otherDigest + " is not the deployed digest " + registry.digest},
+		{name: "signature of another digest", verifier: keyVerifier, payload: simpleSigningPayload(registry.host(), otherDigest), annotations: keySigned(simpleSigningPayload(registry.host(), otherDigest)), outcome: outcomeFail, message: "signature is for digest " + otherDigest},
+		{name: "signed with another key", verifier: keyVerifier, payload: payload, annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(testSign(t, newTestKey(t), []byte(payload)))}, outcome: outcomeFail, message: "does not verify with any cosign-key"},
+		{name: "keyless", verifier: keylessVerifier, payload: payload, annotations: keyless(testSubject), outcome: outcomePass, message: "signed by " + testSubject},
+		{name: "keyless with the wrong identity", verifier: keylessVerifier, payload: payload, annotations: keyless("intruder@example.com"), outcome: outcomeFail, message: "identity intruder@example.com from issuer " + testIssuer + " does not match any cosign-identity"},
+		{name: "unsigned", verifier: keyVerifier, unsigned: true, outcome: outcomeFail, message: "image is not signed"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			registry.layers = nil
+			if !test.unsigned {
+				registry.sign(test.payload, test.annotations)
+			}
+			jobPayload := JobPayload{JetId: "jet-1", ArtifactName: registry.host() + "/team/app", ArtifactTag: "1.0", ArtifactId: test.artifactId}
+			results := checkSignatures(context.Background(), test.verifier, []JobPayload{jobPayload})
+			if len(results) != 1 {
+				t.Fatalf("got %d results, want 1: %+v", len(results), results)
+			}
+			if results[0].Check != signatureCheck || results[0].Outcome != test.outcome || !strings.Contains(results[0].Message, test.message) {
+				t.Errorf("got %s %s: %s, want %s containing %q", results[0].Check, results[0].Outcome, results[0].Message, test.outcome, test.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const defaultSnowIdPattern = `\b(?:CHG|RITM)\d{7,}\b`
+
+var snowIdPattern string
+var snowIdAnnotation string
+
+// extractSnowIds returns every change ticket number found in text. When the pattern has a
+// capturing group only the first group is used, so "(?i)change[: ]+(CHG\d+)" style patterns work.
+func extractSnowIds(text string, pattern string) ([]string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snow-id-pattern %q: %v", pattern, err)
+	}
+	seen := make(map[string]bool)
+	snowIds := make([]string, 0)
+	for _, match := range re.FindAllStringSubmatch(text, -1) {
+		snowId := match[0]
+		if len(match) > 1 && match[1] != "" {
+			snowId = match[1]
+		}
+		snowId = strings.TrimSpace(snowId)
+		if snowId == "" || seen[snowId] {
+			continue
+		}
+		seen[snowId] = true
+		snowIds = append(snowIds, snowId)
+	}
+	return snowIds, nil
+}
+
+// changeTicketIds returns the change tickets to validate. They are read from the application
+// annotation set by --snow-id-annotation, or otherwise from the last commit message.
+func changeTicketIds(ctx context.Context, client *KubeClient) ([]string, error) {
+	source := "git commit message"
+	text := gitCommitMessage
+	if strings.TrimSpace(snowIdAnnotation) != "" {
+		if client == nil {
+			return nil, fmt.Errorf("no kubernetes client to read the change ticket annotation %s of application %s", snowIdAnnotation, argocdAppName)
+		}
+		app, err := client.GetApplication(ctx, argocdNamespace, argocdAppName)
+		if err != nil {
+			return nil, fmt.Errorf("error while fetching application %s for change ticket annotation: %v", argocdAppName, err)
+		}
+		source = fmt.Sprintf("annotation %s on application %s", snowIdAnnotation, argocdAppName)
+		text = app.Metadata.Annotations[snowIdAnnotation]
+	}
+
+	snowIds, err := extractSnowIds(text, snowIdPattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(snowIds) == 0 {
+		return nil, fmt.Errorf("no change ticket matching %s found in %s", snowIdPattern, source)
+	}
+	return snowIds, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+)
+
+var (
+	commitShaPattern = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+	versionPattern   = regexp.MustCompile(`^v?\d+(\.(\d+|\*|x))*([-+].*)?$|^[\^~<>=]`)
+)
+
+// applicationSourceRevision is a source of the application together with the revision argocd synced it to.
+type applicationSourceRevision struct {
+	Source   ApplicationSource
+	Revision string
+}
+
+// sourceRevisions pairs every source with its synced revision. For multi-source applications
+// argocd reports .status.sync.revisions in the same order as .spec.sources.
+func sourceRevisions(app *Application) []applicationSourceRevision {
+	sources := app.Spec.AllSources()
+	results := make([]applicationSourceRevision, 0, len(sources))
+	for i, source := range sources {
+		revision := ""
+		if len(app.Spec.Sources) > 0 {
+			if i < len(app.Status.Sync.Revisions) {
+				revision = app.Status.Sync.Revisions[i]
+			}
+		} else {
+			revision = app.Status.Sync.Revision
+		}
+		results = append(results, applicationSourceRevision{Source: source, Revision: revision})
+	}
+	return results
+}
+
+// mapSourceRevisions fills RepoUrl, Branch and CommitId of every payload from the application
+// source it was deployed from. Values already set on the payload are kept, and Branch is only
+// filled when the target revision names a branch. Only payloads that match no source fall back
+// to --git-branch and --git-last-commitId, so a payload never pairs a flag with a source revision.
+func mapSourceRevisions(app *Application, jobPayloads []JobPayload) {
+	sources := sourceRevisions(app)
+	for i := range jobPayloads {
+		source, ok := matchSource(sources, jobPayloads[i])
+		if !ok {
+			log.Printf("WARNING: no source of application %s matches image %s, using git-branch %q and git-last-commitId %q", app.Metadata.Name, jobPayloads[i].ArtifactName, gitBranch, gitLastCommitId)
+			applyRevisionFlags(&jobPayloads[i])
+			continue
+		}
+		if jobPayloads[i].RepoUrl == "" {
+			jobPayloads[i].RepoUrl = source.Source.RepoURL
+		}
+		if branch, ok := targetBranch(source.Source); ok && jobPayloads[i].Branch == "" {
+			jobPayloads[i].Branch = branch
+		}
+		if jobPayloads[i].CommitId == "" {
+			jobPayloads[i].CommitId = source.Revision
+		}
+	}
+}
+
+// applyRevisionFlags fills the branch and commit a payload does not set from --git-branch and
+// --git-last-commitId, for payloads that cannot be matched to an application source.
+func applyRevisionFlags(payload *JobPayload) {
+	payload.Branch = firstNonEmpty(payload.Branch, gitBranch)
+	payload.CommitId = firstNonEmpty(payload.CommitId, gitLastCommitId)
+}
+
+// targetBranch returns the branch a source tracks. Helm charts, HEAD, commit shas, tags and
+// version-like revisions do not name a branch.
+func targetBranch(source ApplicationSource) (string, bool) {
+	revision := strings.TrimSpace(source.TargetRevision)
+	if source.Chart != "" || revision == "" || revision == "HEAD" || strings.HasPrefix(revision, "refs/tags/") {
+		return "", false
+	}
+	revision = strings.TrimPrefix(revision, "refs/heads/")
+	if commitShaPattern.MatchString(revision) || versionPattern.MatchString(revision) {
+		return "", false
+	}
+	return revision, true
+}
+
+// matchSource finds the source for a payload, by its repoUrl when set, otherwise by a repository
+// named like the image. An application with a single source matches every image.
+func matchSource(sources []applicationSourceRevision, payload JobPayload) (applicationSourceRevision, bool) {
+	if payload.RepoUrl != "" {
+		for _, source := range sources {
+			if normalizeRepoUrl(source.Source.RepoURL) == normalizeRepoUrl(payload.RepoUrl) {
+				return source, true
+			}
+		}
+		return applicationSourceRevision{}, false
+	}
+
+	imageName := payload.ArtifactName
+	if image, err := parseImageReference(payload.ArtifactName); err == nil {
+		imageName = image.ShortName()
+	}
+	for _, source := range sources {
+		if strings.EqualFold(extractImageNameFromRepoUrl(source.Source.RepoURL), imageName) {
+			return source, true
+		}
+	}
+
+	// sources that only provide values files through a ref never deploy images themselves
+	deploying := make([]applicationSourceRevision, 0, len(sources))
+	for _, source := range sources {
+		if source.Source.Ref == "" {
+			deploying = append(deploying, source)
+		}
+	}
+	if len(deploying) == 1 {
+		return deploying[0], true
+	}
+	return applicationSourceRevision{}, false
+}
+
+// extractImageNameFromRepoUrl returns the repository name of a git url, which by convention is the image name.
+func extractImageNameFromRepoUrl(repoURL string) string {
+	name, err := extractRepoName(trimRepoUrl(repoURL))
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// trimRepoUrl drops the trailing slash and .git suffix of a git url, keeping its case.
+func trimRepoUrl(repoURL string) string {
+	repoURL = strings.TrimSuffix(strings.TrimSpace(repoURL), "/")
+	return strings.TrimSuffix(repoURL, ".git")
+}
+
+// normalizeRepoUrl is the form git urls are compared in, hosts and most git servers ignore case.
+func normalizeRepoUrl(repoURL string) string {
+	return strings.ToLower(trimRepoUrl(repoURL))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// withRevisionFlags sets --git-branch and --git-last-commitId for the test.
+func withRevisionFlags(t *testing.T, branch, commit string) {
+	t.Helper()
+	savedBranch, savedCommit := gitBranch, gitLastCommitId
+	t.Cleanup(func() { gitBranch, gitLastCommitId = savedBranch, savedCommit })
+	gitBranch, gitLastCommitId = branch, commit
+}
+
+func singleSourceApp(revision, targetRevision string) *Application {
+	app := &Application{Metadata: ObjectMeta{Name: "payments"}}
+	app.Spec.Source = &ApplicationSource{RepoURL: "https://git.example.com/Team/Payments.git", TargetRevision: targetRevision}
+	app.Status.Sync.Revision = revision
+	return app
+}
+
+func multiSourceApp() *Application {
+	app := &Application{Metadata: ObjectMeta{Name: "shop"}}
+	app.Spec.Sources = []ApplicationSource{
+		{RepoURL: "https://git.example.com/team/cart.git", TargetRevision: "release/2.x"},
+		{RepoURL: "https://git.example.com/team/checkout", TargetRevision: "a1b2c3d4e5f60718293a4b5c6d7e8f9012345678"},
+		{RepoURL: "https://git.example.com/team/values.git", TargetRevision: "main", Ref: "values"},
+		{RepoURL: "https://charts.example.com", Chart: "search", TargetRevision: "1.4.2"},
+	}
+	app.Status.Sync.Revisions = []string{"1111111", "a1b2c3d4e5f60718293a4b5c6d7e8f9012345678", "3333333", "1.4.2"}
+	return app
+}
+
+func TestMapSourceRevisions(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		app     *Application
+		payload JobPayload
+		want    JobPayload
+	}{
+		{
+			name:    "single source tracking a branch",
+			app:     singleSourceApp("abc1234", "main"),
+			payload: JobPayload{ArtifactName: "registry.example.com/team/api"},
+			want:    JobPayload{RepoUrl: "https://git.example.com/Team/Payments.git", Branch: "main", CommitId: "abc1234"},
+		},
+		{
+			name:    "single source tracking refs/heads",
+			app:     singleSourceApp("abc1234", "refs/heads/feature/login"),
+			payload: JobPayload{ArtifactName: "api"},
+			want:    JobPayload{RepoUrl: "https://git.example.com/Team/Payments.git", Branch: "feature/login", CommitId: "abc1234"},
+		},
+		{
+			name:    "single source pinned to a sha keeps the flag branch away",
+			app:     singleSourceApp("abc1234", "abc1234"),
+			payload: JobPayload{ArtifactName: "api"},
+			want:    JobPayload{RepoUrl: "https://git.example.com/Team/Payments.git", CommitId: "abc1234"},
+		},
+		{
+			name:    "single source on a semver tag",
+			app:     singleSourceApp("def5678", "v1.2.3"),
+			payload: JobPayload{ArtifactName: "api"},
+			want:    JobPayload{RepoUrl: "https://git.example.com/Team/Payments.git", CommitId: "def5678"},
+		},
+		{
+			name:    "single source on HEAD",
+			app:     singleSourceApp("def5678", "HEAD"),
+			payload: JobPayload{ArtifactName: "api"},
+			want:    JobPayload{RepoUrl: "https://git.example.com/Team/Payments.git", CommitId: "def5678"},
+		},
+		{
+			name:    "single source without target revision",
+			app:     singleSourceApp("def5678", ""),
+			payload: JobPayload{ArtifactName: "api"},
+			want:    JobPayload{RepoUrl: "https://git.example.com/Team/Payments.git", CommitId: "def5678"},
+		},
+		{
+			name:    "payload values are kept",
+			app:     singleSourceApp("abc1234", "main"),
+			payload: JobPayload{ArtifactName: "api", Branch: "hotfix", CommitId: "fedcba9"},
+			want:    JobPayload{RepoUrl: "https://git.example.com/Team/Payments.git", Branch: "hotfix", CommitId: "fedcba9"},
+		},
+		{
+			name:    "multi source matched by image name",
+			app:     multiSourceApp(),
+			payload: JobPayload{ArtifactName: "registry.example.com/team/cart"},
+			want:    JobPayload{RepoUrl: "https://git.example.com/team/cart.git", Branch: "release/2.x", CommitId: "1111111"},
+		},
+		{
+			name:    "multi source matched by repo url ignoring case and .git",
+			app:     multiSourceApp(),
+			payload: JobPayload{ArtifactName: "registry.example.com/team/web", RepoUrl: "https://git.example.com/Team/Checkout.git/"},
+			want:    JobPayload{RepoUrl: "https://git.example.com/Team/Checkout.git/", CommitId: "a1b2c3d4e5f60718293a4b5c6d7e8f9012345678"},
+		},
+		{
+			name:    "multi source without a match falls back to the flags",
+			app:     multiSourceApp(),
+			payload: JobPayload{ArtifactName: "registry.example.com/team/unknown"},
+			want:    JobPayload{Branch: "flag-branch", CommitId: "flagcommit"},
+		},
+		{
+			name:    "repo url matching no source falls back to the flags",
+			app:     multiSourceApp(),
+			payload: JobPayload{ArtifactName: "cart", RepoUrl: "https://git.example.com/team/other"},
+			want:    JobPayload{RepoUrl: "https://git.example.com/team/other", Branch: "flag-branch", CommitId: "flagcommit"},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			withRevisionFlags(t, "flag-branch", "flagcommit")
+			payloads := []JobPayload{test.payload}
+			mapSourceRevisions(test.app, payloads)
+			got := payloads[0]
+			if got.RepoUrl != test.want.RepoUrl || got.Branch != test.want.Branch || got.CommitId != test.want.CommitId {
+				t.Errorf("got repo %q branch %q commit %q, want repo %q branch %q commit %q",
+					got.RepoUrl, got.Branch, got.CommitId, test.want.RepoUrl, test.want.Branch, test.want.CommitId)
+			}
+		})
+	}
+}
+
+func TestSourceRevisions(t *testing.T) {
+	app := multiSourceApp()
+	app.Status.Sync.Revisions = app.Status.Sync.Revisions[:2]
+	revisions := sourceRevisions(app)
+	if len(revisions) != 4 {
+		t.Fatalf("got %d sources, want 4", len(revisions))
+	}
+	for i, want := range []string{"1111111", "a1b2c3d4e5f60718293a4b5c6d7e8f9012345678", "", ""} {
+		if revisions[i].Revision != want {
+			t.Errorf("source %d revision %q, want %q", i, revisions[i].Revision, want)
+		}
+	}
+	if revisions := sourceRevisions(&Application{}); len(revisions) != 0 {
+		t.Errorf("application without sources returned %v", revisions)
+	}
+}
+
+func TestTargetBranch(t *testing.T) {
+	for _, test := range []struct {
+		source ApplicationSource
+		want   string
+	}{
+		{ApplicationSource{TargetRevision: "main"}, "main"},
+		{ApplicationSource{TargetRevision: " develop "}, "develop"},
+		{ApplicationSource{TargetRevision: "refs/heads/release/1.x"}, "release/1.x"},
+		{ApplicationSource{TargetRevision: "fix-export"}, "fix-export"},
+		{ApplicationSource{TargetRevision: ""}, ""},
+		{ApplicationSource{TargetRevision: "HEAD"}, ""},
+		{ApplicationSource{TargetRevision: "refs/tags/v1.0.0"}, ""},
+		{ApplicationSource{TargetRevision: "abc1234"}, ""},
+		{ApplicationSource{TargetRevision: "a1b2c3d4e5f60718293a4b5c6d7e8f9012345678"}, ""},
+		{ApplicationSource{TargetRevision: "v1.2.3"}, ""},
+		{ApplicationSource{TargetRevision: "1.2.3-rc.1"}, ""},
+		{ApplicationSource{TargetRevision: "1.*"}, ""},
+		{ApplicationSource{TargetRevision: "^1.2"}, ""},
+		{ApplicationSource{TargetRevision: ">=1.0.0 <2.0.0"}, ""},
+		{ApplicationSource{TargetRevision: "main", Chart: "payments"}, ""},
+	} {
+		got, ok := targetBranch(test.source)
+		if got != test.want || ok != (test.want != "") {
+			t.Errorf("targetBranch(%+v) = %q, %v, want %q", test.source, got, ok, test.want)
+		}
+	}
+}
+
+func TestMakeDeploymentPayloadKeepsRepoNameCase(t *testing.T) {
+	withRevisionFlags(t, "flag-branch", "flagcommit")
+	payload, err := MakeDeploymentPayload(JobPayload{RepoUrl: "https://git.example.com/Team/PaymentsAPI", Branch: "main", CommitId: "abc1234"}, DeploymentEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"repoName":"PaymentsAPI"`, `"branch":"main"`, `"commitId":"abc1234"`} {
+		if !strings.Contains(payload, want) {
+			t.Errorf("payload %s does not contain %s", payload, want)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// spoolTimeout bounds spooling a submission that timed out with the run.
+	spoolTimeout = 10 * time.Second
+)
+
+var spoolDir, spoolConfigMap string
+
+// SpooledDeployment is a deployment submission that failed and waits to be replayed.
+type SpooledDeployment struct {
+	IdempotencyKey string `json:"idempotencyKey"`
+	Url            string `json:"url"`
+	Payload        string `json:"payload"`
+	SpooledAt      string `json:"spooledAt"`
+	LastError      string `json:"lastError"`
+}
+
+// DeploymentSpool durably keeps failed deployment submissions until they are delivered.
+type DeploymentSpool interface {
+	Save(ctx context.Context, deployment SpooledDeployment) error
+	List(ctx context.Context) ([]SpooledDeployment, error)
+	Remove(ctx context.Context, idempotencyKey string) error
+}
+
+// deploymentIdempotencyKey identifies a submission by application, revision, artifact and outcome,
+// so a retried hook sends the same key and the receiver can drop the duplicate.
+func deploymentIdempotencyKey(payload JobPayload, event DeploymentEvent) string {
+	parts := []string{
+		argocdNamespace,
+		argocdAppName,
+		firstNonEmpty(payload.CommitId, gitLastCommitId),
+		payload.ArtifactName,
+		payload.ArtifactTag,
+		payload.ArtifactId,
+		event.Status,
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewDeploymentSpool returns the spool configured by --spool-dir or --spool-configmap, or nil when neither is set.
+func NewDeploymentSpool(kubeClient *KubeClient) (DeploymentSpool, error) {
+	if strings.TrimSpace(spoolDir) != "" && strings.TrimSpace(spoolConfigMap) != "" {
+		return nil, errors.New("only one of spool-dir and spool-configmap can be set")
+	}
+	if strings.TrimSpace(spoolDir) != "" {
+		if err := os.MkdirAll(spoolDir, 0o700); err != nil {
+			return nil, fmt.Errorf("error creating spool directory %s: %v", spoolDir, err)
+		}
+		return &FileDeploymentSpool{dir: spoolDir}, nil
+	}
+	if strings.TrimSpace(spoolConfigMap) != "" {
+		if kubeClient == nil {
+			client, err := NewKubeClient()
+			if err != nil {
+				return nil, fmt.Errorf("error while creating kubernetes client for the spool configmap: %v", err)
+			}
+			kubeClient = client
+		}
+		return &ConfigMapDeploymentSpool{client: kubeClient, namespace: argocdNamespace, name: spoolConfigMap}, nil
+	}
+	return nil, nil
+}
+
+// FileDeploymentSpool keeps one json file per submission in a directory, typically a mounted volume.
+type FileDeploymentSpool struct {
+	dir string
+}
+
+func (s *FileDeploymentSpool) Save(ctx context.Context, deployment SpooledDeployment) error {
+	content, err := json.Marshal(deployment)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so a crash never leaves a half written entry behind
+	path := filepath.Join(s.dir, deployment.IdempotencyKey+".json")
+	if err := os.WriteFile(path+".tmp", content, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *FileDeploymentSpool) List(ctx context.Context) ([]SpooledDeployment, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	deployments := make([]SpooledDeployment, 0, len(paths))
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var deployment SpooledDeployment
+		if err := json.Unmarshal(content, &deployment); err != nil {
+			return nil, fmt.Errorf("error parsing spooled deployment %s: %v", path, err)
+		}
+		deployments = append(deployments, deployment)
+	}
+	sortSpooledDeployments(deployments)
+	return deployments, nil
+}
+
+func (s *FileDeploymentSpool) Remove(ctx context.Context, idempotencyKey string) error {
+	err := os.Remove(filepath.Join(s.dir, idempotencyKey+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// ConfigMapDeploymentSpool keeps submissions as keys of a ConfigMap, so they survive the hook pod.
+type ConfigMapDeploymentSpool struct {
+	client    *KubeClient
+	namespace string
+	name      string
+}
+
+func (s *ConfigMapDeploymentSpool) Save(ctx context.Context, deployment SpooledDeployment) error {
+	content, err := json.Marshal(deployment)
+	if err != nil {
+		return err
+	}
+	value := string(content)
+	return s.client.PatchConfigMapData(ctx, s.namespace, s.name, map[string]*string{deployment.IdempotencyKey: &value})
+}
+
+func (s *ConfigMapDeploymentSpool) List(ctx context.Context) ([]SpooledDeployment, error) {
+	configMap, err := s.client.GetConfigMap(ctx, s.namespace, s.name)
+	if errors.Is(err, ErrNotFound) {
+		return []SpooledDeployment{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	deployments := make([]SpooledDeployment, 0, len(configMap.Data))
+	for key, value := range configMap.Data {
+		var deployment SpooledDeployment
+		if err := json.Unmarshal([]byte(value), &deployment); err != nil {
+			return nil, fmt.Errorf("error parsing spooled deployment %s in configmap %s: %v", key, s.name, err)
+		}
+		deployments = append(deployments, deployment)
+	}
+	sortSpooledDeployments(deployments)
+	return deployments, nil
+}
+
+func (s *ConfigMapDeploymentSpool) Remove(ctx context.Context, idempotencyKey string) error {
+	return s.client.PatchConfigMapData(ctx, s.namespace, s.name, map[string]*string{idempotencyKey: nil})
+}
+
+func sortSpooledDeployments(deployments []SpooledDeployment) {
+	sort.Slice(deployments, func(i, j int) bool {
+		return deployments[i].SpooledAt < deployments[j].SpooledAt
+	})
+}
+
+// spoolDeployment keeps a failed submission for a later replay.
+func spoolDeployment(ctx context.Context, spool DeploymentSpool, url, idempotencyKey, payload string, cause error) error {
+	return spool.Save(ctx, SpooledDeployment{
+		IdempotencyKey: idempotencyKey,
+		Url:            url,
+		Payload:        payload,
+		SpooledAt:      time.Now().UTC().Format(time.RFC3339),
+		LastError:      redactSecrets(cause.Error()),
+	})
+}
+
+// replaySpool resubmits every spooled deployment and removes the delivered ones.
+// It returns how many are still spooled.
+func replaySpool(ctx context.Context, spool DeploymentSpool) (int, error) {
+	deployments, err := spool.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error listing spooled deployments: %v", err)
+	}
+	remaining := 0
+	for _, deployment := range deployments {
+		statusCode, _, err := postToHost(submitDeploymentClient, deployment.Url, []byte(deployment.Payload), deployment.IdempotencyKey)
+		if err == nil && statusCode != http.StatusOK {
+			err = fmt.Errorf("httpstatus code %d", statusCode)
+		}
+		if err != nil {
+			log.Printf("WARNING: replay of spooled deployment %s from %s failed: %v", deployment.IdempotencyKey, deployment.SpooledAt, err)
+			remaining++
+			continue
+		}
+		if err := spool.Remove(ctx, deployment.IdempotencyKey); err != nil {
+			return remaining, fmt.Errorf("error removing delivered deployment %s from the spool: %v", deployment.IdempotencyKey, err)
+		}
+		log.Printf("SUCCESS: Spooled deployment %s from %s delivered", deployment.IdempotencyKey, deployment.SpooledAt)
+	}
+	return remaining, nil
+}
+
+// RunFlush replays the spool for the flush subcommand and fails while anything remains undelivered.
+func RunFlush(ctx context.Context) error {
+	if err := requireServiceToken(submitDeploymentEndpoint); err != nil {
+		return err
+	}
+	spool, err := NewDeploymentSpool(nil)
+	if err != nil {
+		return err
+	}
+	if spool == nil {
+		return errors.New("either spool-dir or spool-configmap has to be set to flush spooled deployments")
+	}
+	remaining, err := replaySpool(ctx, spool)
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%d spooled deployments could not be delivered", remaining)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// withSpoolFlags sets --spool-dir, --spool-configmap and the argocd namespace for the test.
+func withSpoolFlags(t *testing.T, dir, configMap string) {
+	t.Helper()
+	savedDir, savedConfigMap, savedNamespace := spoolDir, spoolConfigMap, argocdNamespace
+	t.Cleanup(func() { spoolDir, spoolConfigMap, argocdNamespace = savedDir, savedConfigMap, savedNamespace })
+	spoolDir, spoolConfigMap, argocdNamespace = dir, configMap, "argocd"
+}
+
+// deploymentReceiver accepts submissions unless their payload contains reject and records the
+// idempotency keys it was sent.
+type deploymentReceiver struct {
+	*httptest.Server
+	mu   sync.Mutex
+	keys []string
+}
+
+func newDeploymentReceiver(t *testing.T, reject string) *deploymentReceiver {
+	t.Helper()
+	receiver := &deploymentReceiver{}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		receiver.mu.Lock()
+		receiver.keys = append(receiver.keys, r.Header.Get(idempotencyKeyHeader))
+		receiver.mu.Unlock()
+		if reject != "" && strings.Contains(string(body), reject) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"status":"accepted"}`)
+	}))
+	t.Cleanup(receiver.Close)
+	saved := submitDeploymentClient
+	t.Cleanup(func() { submitDeploymentClient = saved })
+	submitDeploymentClient = receiver.Client()
+	return receiver
+}
+
+func (r *deploymentReceiver) sentKeys() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.keys...)
+}
+
+func spooledKeys(t *testing.T, spool DeploymentSpool) []string {
+	t.Helper()
+	deployments, err := spool.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(deployments))
+	for _, deployment := range deployments {
+		keys = append(keys, deployment.IdempotencyKey)
+	}
+	return keys
+}
+
+// testSpools returns a file spool and a ConfigMap spool against the fake api server.
+func testSpools() map[string]func(t *testing.T) DeploymentSpool {
+	return map[string]func(t *testing.T) DeploymentSpool{
+		"file": func(t *testing.T) DeploymentSpool {
+			withSpoolFlags(t, filepath.Join(t.TempDir(), "spool"), "")
+			spool, err := NewDeploymentSpool(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return spool
+		},
+		"configmap": func(t *testing.T) DeploymentSpool {
+			var seen []string
+			server := fakeApiServer(t, "Bearer api-token", &seen)
+			withSpoolFlags(t, "", "policy-job-spool")
+			spool, err := NewDeploymentSpool(newKubeClientForHost(server.URL, "api-token", server.Client()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return spool
+		},
+	}
+}
+
+func TestDeploymentSpool(t *testing.T) {
+	for name, newSpool := range testSpools() {
+		t.Run(name, func(t *testing.T) {
+			spool := newSpool(t)
+			ctx := context.Background()
+			if keys := spooledKeys(t, spool); len(keys) != 0 {
+				t.Fatalf("new spool lists %v", keys)
+			}
+
+			for _, deployment := range []SpooledDeployment{
+				{IdempotencyKey: "second", Url: "https://deploy.example.com", Payload: `{"jetId":"2"}`, SpooledAt: "2024-05-01T10:00:02Z"},
+				{IdempotencyKey: "first", Url: "https://deploy.example.com", Payload: `{"jetId":"1"}`, SpooledAt: "2024-05-01T10:00:01Z"},
+				// spooling the same key again replaces the entry
+				{IdempotencyKey: "second", Url: "https://deploy.example.com", Payload: `{"jetId":"2"}`, SpooledAt: "2024-05-01T10:00:03Z", LastError: "timed out"},
+			} {
+				if err := spool.Save(ctx, deployment); err != nil {
+					t.Fatal(err)
+				}
+			}
+			deployments, err := spool.List(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(deployments) != 2 || deployments[0].IdempotencyKey != "first" || deployments[1].LastError != "timed out" {
+				t.Fatalf("listed %+v, want first and the replaced second in spool order", deployments)
+			}
+
+			if err := spool.Remove(ctx, "first"); err != nil {
+				t.Fatal(err)
+			}
+			if err := spool.Remove(ctx, "first"); err != nil {
+				t.Errorf("removing a removed entry: %v", err)
+			}
+			if keys := spooledKeys(t, spool); strings.Join(keys, ",") != "second" {
+				t.Errorf("spool holds %v after removing first", keys)
+			}
+		})
+	}
+}
+
+func TestFileDeploymentSpoolLeavesNoTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	spool := &FileDeploymentSpool{dir: dir}
+	if err := spool.Save(context.Background(), SpooledDeployment{IdempotencyKey: "key", Payload: "{}"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "key.json" {
+		t.Errorf("spool directory holds %v", entries)
+	}
+}
+
+func TestNewDeploymentSpoolRejectsBoth(t *testing.T) {
+	withSpoolFlags(t, t.TempDir(), "policy-job-spool")
+	if _, err := NewDeploymentSpool(nil); err == nil {
+		t.Error("expected an error when both spool-dir and spool-configmap are set")
+	}
+}
+
+func TestDeploymentIdempotencyKey(t *testing.T) {
+	withSpoolFlags(t, "", "")
+	withRevisionFlags(t, "main", "flagcommit")
+	savedApp := argocdAppName
+	defer func() { argocdAppName = savedApp }()
+	argocdAppName = "payments"
+
+	payload := JobPayload{ArtifactName: "registry.example.com/team/api", ArtifactTag: "1.0", ArtifactId: "sha256:abc", CommitId: "abc1234"}
+	success := DeploymentEvent{Status: deploymentEventSuccess}
+	key := deploymentIdempotencyKey(payload, success)
+	if again := deploymentIdempotencyKey(payload, success); again != key {
+		t.Errorf("the same submission got keys %s and %s", key, again)
+	}
+	otherCommit := payload
+	otherCommit.CommitId = "def5678"
+	withoutCommit := payload
+	withoutCommit.CommitId = ""
+	for name, other := range map[string]string{
+		"other commit":       deploymentIdempotencyKey(otherCommit, success),
+		"other status":       deploymentIdempotencyKey(payload, DeploymentEvent{Status: "failure"}),
+		"commit of the flag": deploymentIdempotencyKey(withoutCommit, success),
+	} {
+		if other == key {
+			t.Errorf("%s: got the same key", name)
+		}
+	}
+}
+
+func TestReplaySpool(t *testing.T) {
+	for name, newSpool := range testSpools() {
+		t.Run(name, func(t *testing.T) {
+			receiver := newDeploymentReceiver(t, "rejected")
+			spool := newSpool(t)
+			ctx := context.Background()
+			for i, payload := range []string{`{"jetId":"delivered"}`, `{"jetId":"rejected"}`} {
+				deployment := SpooledDeployment{IdempotencyKey: fmt.Sprintf("key-%d", i), Url: receiver.URL, Payload: payload, SpooledAt: fmt.Sprintf("2024-05-01T10:00:0%dZ", i)}
+				if err := spool.Save(ctx, deployment); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			remaining, err := replaySpool(ctx, spool)
+			if err != nil || remaining != 1 {
+				t.Fatalf("replaySpool = %d, %v, want 1 remaining", remaining, err)
+			}
+			if keys := spooledKeys(t, spool); strings.Join(keys, ",") != "key-1" {
+				t.Errorf("spool holds %v, want only the rejected deployment", keys)
+			}
+			if keys := receiver.sentKeys(); strings.Join(keys, ",") != "key-0,key-1" {
+				t.Errorf("replay sent idempotency keys %v, want the spooled ones", keys)
+			}
+		})
+	}
+}
+
+func TestRunFlush(t *testing.T) {
+	savedEndpoints := serviceTokenEndpoints
+	defer func() { serviceTokenEndpoints = savedEndpoints }()
+	serviceTokenEndpoints = make(map[string]bool)
+	withSpoolFlags(t, "", "")
+	if err := RunFlush(context.Background()); err == nil || !strings.Contains(err.Error(), "spool-dir or spool-configmap") {
+		t.Errorf("flush without a spool: %v", err)
+	}
+
+	receiver := newDeploymentReceiver(t, "rejected")
+	withSpoolFlags(t, t.TempDir(), "")
+	spool := &FileDeploymentSpool{dir: spoolDir}
+	if err := spool.Save(context.Background(), SpooledDeployment{IdempotencyKey: "rejected", Url: receiver.URL, Payload: `{"jetId":"rejected"}`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunFlush(context.Background()); err == nil || !strings.Contains(err.Error(), "1 spooled deployments could not be delivered") {
+		t.Errorf("flush with an undeliverable deployment: %v", err)
+	}
+
+	if err := spool.Remove(context.Background(), "rejected"); err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Save(context.Background(), SpooledDeployment{IdempotencyKey: "delivered", Url: receiver.URL, Payload: `{"jetId":"delivered"}`}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunFlush(context.Background()); err != nil {
+		t.Errorf("flush: %v", err)
+	}
+	if keys := spooledKeys(t, spool); len(keys) != 0 {
+		t.Errorf("spool holds %v after a successful flush", keys)
+	}
+}
+
+func TestSubmitDeploymentStewardSpools(t *testing.T) {
+	payload := JobPayload{JetId: "jet-1", ArtifactName: "registry.example.com/team/api", RepoUrl: "https://git.example.com/team/api", CommitId: "abc1234"}
+	event := DeploymentEvent{Status: deploymentEventSuccess}
+	submit := func(ctx context.Context, url string, spool DeploymentSpool) CheckResult {
+		results := make(chan CheckResult, 1)
+		startSubmitDeploymentSteward(ctx, url, payload, event, spool, results)
+		return <-results
+	}
+
+	t.Run("rejected submission", func(t *testing.T) {
+		receiver := newDeploymentReceiver(t, "jet-1")
+		spool := &FileDeploymentSpool{dir: t.TempDir()}
+		if result := submit(context.Background(), receiver.URL, spool); result.Outcome != outcomeWarn {
+			t.Errorf("got %s: %s, want the submission spooled", result.Outcome, result.Message)
+		}
+		deployments, err := spool.List(context.Background())
+		if err != nil || len(deployments) != 1 {
+			t.Fatalf("spool holds %v, %v", deployments, err)
+		}
+		if sent := receiver.sentKeys(); len(sent) != 1 || deployments[0].IdempotencyKey != sent[0] || deployments[0].IdempotencyKey != deploymentIdempotencyKey(payload, event) {
+			t.Errorf("spooled key %s, sent %v", deployments[0].IdempotencyKey, sent)
+		}
+	})
+
+	t.Run("timed out submission", func(t *testing.T) {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer server.Close()
+		defer close(release)
+		saved := submitDeploymentClient
+		defer func() { submitDeploymentClient = saved }()
+		submitDeploymentClient = server.Client()
+
+		for name, spool := range map[string]DeploymentSpool{"spool": &FileDeploymentSpool{dir: t.TempDir()}, "no spool": nil} {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			result := submit(ctx, server.URL, spool)
+			cancel()
+			if spool == nil {
+				if result.Outcome != outcomeError || !strings.Contains(result.Message, "timed out") {
+					t.Errorf("%s: got %s: %s, want a timeout error", name, result.Outcome, result.Message)
+				}
+				continue
+			}
+			if result.Outcome != outcomeWarn {
+				t.Errorf("%s: got %s: %s, want the submission spooled", name, result.Outcome, result.Message)
+			}
+			deployments, err := spool.List(context.Background())
+			if err != nil || len(deployments) != 1 || !strings.Contains(deployments[0].LastError, "timed out") {
+				t.Errorf("%s: spool holds %+v, %v", name, deployments, err)
+			}
+		}
+	})
+}
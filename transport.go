@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	noProxy            = "none"
+	transportFlagUsage = "overrides the transport defaults as ca-file=<path>,proxy=<url>|none,tls-min-version=1.2,connect-timeout=30s,tls-handshake-timeout=10s,response-header-timeout=0s,request-timeout=600s"
+)
+
+var releaseCheckTransport, servicenowTransport, submitDeploymentTransport, registryTransport string
+
+// defaultTransport holds the transport flags every endpoint starts from.
+var defaultTransport = TransportOptions{
+	TLSMinVersion:       "1.2",
+	ConnectTimeout:      30 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+	RequestTimeout:      timeout * time.Second,
+}
+
+// TransportOptions configures how the client of an endpoint connects. Without a proxy the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables apply, "none" disables proxying.
+// The CA file is added to the system roots. A zero timeout means no timeout.
+type TransportOptions struct {
+	CAFile                string
+	Proxy                 string
+	TLSMinVersion         string
+	ConnectTimeout        time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	RequestTimeout        time.Duration
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTransportSpec applies an --<endpoint>-transport flag on top of the transport defaults.
+func parseTransportSpec(endpoint, spec string, options *TransportOptions) error {
+	flag := endpoint + "-transport"
+	for _, part := range strings.Split(spec, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return fmt.Errorf("%s: %q should be key=value", flag, part)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		var duration *time.Duration
+		switch key {
+		case "ca-file":
+			options.CAFile = value
+		case "proxy":
+			options.Proxy = value
+		case "tls-min-version":
+			options.TLSMinVersion = value
+		case "connect-timeout":
+			duration = &options.ConnectTimeout
+		case "tls-handshake-timeout":
+			duration = &options.TLSHandshakeTimeout
+		case "response-header-timeout":
+			duration = &options.ResponseHeaderTimeout
+		case "request-timeout":
+			duration = &options.RequestTimeout
+		default:
+			return fmt.Errorf("%s: unknown key %q", flag, key)
+		}
+		if duration != nil {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed < 0 {
+				return fmt.Errorf("%s: %s %q should be a duration like 30s", flag, key, value)
+			}
+			*duration = parsed
+		}
+	}
+	return nil
+}
+
+// newTransport builds the transport of an endpoint. It fails when the CA file cannot be read,
+// so a broken trust bundle stops the run at startup rather than at the first request.
+func newTransport(endpoint string, options TransportOptions, certificate *clientCertificate) (*http.Transport, error) {
+	minVersion, ok := tlsVersions[options.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("%s: tls-min-version %q should be 1.0, 1.1, 1.2 or 1.3", endpoint, options.TLSMinVersion)
+	}
+	tlsConfig := &tls.Config{MinVersion: minVersion}
+	if options.CAFile != "" {
+		pem, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: error reading ca-file: %v", endpoint, err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: ca-file %s does not contain any PEM certificate", endpoint, options.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if certificate != nil {
+		tlsConfig.GetClientCertificate = certificate.GetClientCertificate
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	transport.DialContext = (&net.Dialer{Timeout: options.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = options.TLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = options.ResponseHeaderTimeout
+	switch options.Proxy {
+	case "":
+		transport.Proxy = http.ProxyFromEnvironment
+	case noProxy:
+		transport.Proxy = nil
+	default:
+		proxyUrl, err := url.Parse(options.Proxy)
+		if err != nil || proxyUrl.Host == "" {
+			return nil, fmt.Errorf("%s: proxy %q should be a url like http://proxy:3128", endpoint, options.Proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+	return transport, nil
+}